@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	calendar "google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// addEventLengths are the choices offered for how long an event lasts, in
+// minutes; 0 is all day.
+var addEventLengths = []struct {
+	Minutes int
+	Label   string
+}{{30, "30 minutes"}, {60, "1 hour"}, {90, "1½ hours"}, {120, "2 hours"}, {180, "3 hours"}, {0, "All day"}}
+
+// handleAddEvent adds /add, a page for adding events to the Google
+// calendars in config.Calendars from the planner's touchscreen or a phone,
+// to mux.  It is only there if config.CalendarAddEvents is set, as the
+// planner then needs permission to change calendars rather than just read
+// them, and asks for the upload PIN, signing in as the upload page does.
+func handleAddEvent(mux *http.ServeMux, config configStruct) {
+	if !config.CalendarAddEvents {
+		return
+	}
+	if config.UploadPIN == "" {
+		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Adding events disabled, uploadPIN is not set\n")
+		return
+	}
+	if uploadAuth.secret == nil {
+		// handleUploads couldn't make one, and has logged why
+		return
+	}
+
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			showAddEventPage(w, r, config, r.URL.Query().Get("msg"))
+		case r.Method != http.MethodPost:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case !sameOrigin(r):
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		case !uploadAuthorized(r, config):
+			http.Redirect(w, r, "/add", http.StatusSeeOther)
+		default:
+			redirectAddEvent(w, r, addEvent(r, config))
+		}
+	})
+	mux.HandleFunc("/add/pin", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPost:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case !sameOrigin(r):
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			redirectAddEvent(w, r, checkPIN(w, r, config))
+		}
+	})
+}
+
+func redirectAddEvent(w http.ResponseWriter, r *http.Request, msg string) {
+	target := "/add"
+	if msg != "" {
+		target += "?msg=" + url.QueryEscape(msg)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a POST came from a page on the planner,
+// going by its Origin header, or its Referer if it has none.  Browsers
+// send one or the other with a form, so a page on another site can't
+// post to the planner with a signed-in phone's cookie.
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Referer()
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// addEventCalendars are the calendars events can be added to: the Google
+// ones, as quick add is Google's.
+func addEventCalendars(config configStruct) []calendarConfig {
+	var calendars []calendarConfig
+	for _, cal := range calendarsToShow(config) {
+		if cal.Type == "" || cal.Type == "google" {
+			calendars = append(calendars, cal)
+		}
+	}
+	return calendars
+}
+
+// addEvent adds the event described by the form, either as quick add text
+// such as "Dentist Tue 3pm", which Google works out, or as a title, date,
+// time and length.  It returns a message saying how it went.
+func addEvent(r *http.Request, config configStruct) string {
+	var cal calendarConfig
+	found := false
+	for _, c := range addEventCalendars(config) {
+		if c.ID == r.FormValue("calendar") {
+			cal, found = c, true
+		}
+	}
+	if !found {
+		return "Choose a calendar to add the event to."
+	}
+
+	srv, err := googleService(config)
+	if err != nil {
+		if errors.Is(err, errNeedsAuth) {
+			return "Connect Google Calendar first: follow the instructions on the planner's screen."
+		}
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Adding event: "+err.Error()+"\n")
+		return "Google Calendar isn't available, please try again later."
+	}
+
+	var event *calendar.Event
+	if text := strings.TrimSpace(r.FormValue("text")); text != "" {
+		event, err = srv.Events.QuickAdd(cal.ID, text).Do()
+	} else {
+		var e *calendar.Event
+		e, err = formEvent(r)
+		if err != nil {
+			return err.Error()
+		}
+		event, err = srv.Events.Insert(cal.ID, e).Do()
+	}
+	if err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Adding event to "+cal.Name+": "+err.Error()+"\n")
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden && strings.Contains(strings.ToLower(apiErr.Message), "insufficient") {
+			// The token was granted before adding events was turned on
+			os.Remove(tokenFile)
+			if oauthConfig, cerr := calendarOAuthConfig(config); cerr == nil {
+				startCalendarAuth(config, oauthConfig)
+			}
+			return "The planner needs permission to add events: sign in to Google again, following the instructions on the planner's screen."
+		}
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+			return "You can't add events to " + cal.Name + "."
+		}
+		return "Google Calendar didn't add the event, please try again."
+	}
+
+	added := calendarEvent{Summary: event.Summary, Start: eventStart(event.Start), AllDay: event.Start != nil && event.Start.DateTime == ""}
+	when := added.Start.Format("Mon Jan 2 at 3:04pm")
+	if added.AllDay {
+		when = added.Start.Format("Mon Jan 2")
+	}
+	logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Added "+added.Summary+" ("+when+") to "+cal.Name+" from "+r.RemoteAddr+"\n")
+	go getCalendar(config)
+	return "Added “" + added.Summary + "” to " + cal.Name + " on " + when + "."
+}
+
+// formEvent makes an event from the title, date, time and length fields.
+func formEvent(r *http.Request) (*calendar.Event, error) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		return nil, errors.New("Type what the event is, e.g. “Dentist Tue 3pm”.")
+	}
+	day, err := time.ParseInLocation("2006-01-02", r.FormValue("date"), time.Local)
+	if err != nil {
+		return nil, errors.New("Choose the day of the event.")
+	}
+	minutes := 60
+	for _, l := range addEventLengths {
+		if r.FormValue("length") == l.Label {
+			minutes = l.Minutes
+		}
+	}
+
+	e := &calendar.Event{Summary: title}
+	if minutes == 0 || r.FormValue("time") == "" {
+		e.Start = &calendar.EventDateTime{Date: day.Format("2006-01-02")}
+		e.End = &calendar.EventDateTime{Date: day.AddDate(0, 0, 1).Format("2006-01-02")}
+		return e, nil
+	}
+	clock, err := time.Parse("15:04", r.FormValue("time"))
+	if err != nil {
+		return nil, errors.New("Choose the time of the event.")
+	}
+	start := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	e.Start = &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)}
+	e.End = &calendar.EventDateTime{DateTime: start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)}
+	return e, nil
+}
+
+func showAddEventPage(w http.ResponseWriter, r *http.Request, config configStruct, msg string) {
+	page := struct {
+		Authorized bool
+		Message    string
+		Calendars  []calendarConfig
+		Lengths    interface{}
+		Today      string
+	}{uploadAuthorized(r, config), msg, addEventCalendars(config), addEventLengths, time.Now().Format("2006-01-02")}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := addEventPage.Execute(w, page); err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Rendering add event page: "+err.Error()+"\n")
+	}
+}
+
+var addEventPage = template.Must(template.New("add").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Add Event</title>
+<style>
+body { font-family: sans-serif; margin: 1rem; background: #1b2a41; color: white; font-size: 1.3rem; }
+a { color: #9cf; }
+input, select, button { font-size: 1.4rem; margin: 0.3rem 0; padding: 0.5rem; width: 100%; box-sizing: border-box; }
+button { background: #4285f4; color: white; border: none; border-radius: 0.4rem; padding: 0.8rem; }
+label { display: block; margin-top: 0.6rem; }
+.calendars label { display: inline-block; margin-right: 1rem; }
+.calendars input { width: auto; transform: scale(1.5); margin-right: 0.5rem; }
+.dot { display: inline-block; width: 0.8em; height: 0.8em; border-radius: 50%; margin-right: 0.3em; }
+.msg { background: rgba(255, 255, 255, 0.15); padding: 0.5rem; border-radius: 0.4rem; }
+.or { text-align: center; margin: 1rem 0 0.2rem; opacity: 0.7; }
+</style>
+</head>
+<body>
+<h1>Add Event</h1>
+<p><a href="/">Back to the planner</a></p>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+{{if not .Authorized}}
+<form method="post" action="/add/pin">
+<input type="password" name="pin" inputmode="numeric" autocomplete="off" placeholder="PIN" autofocus>
+<button type="submit">Sign in</button>
+</form>
+{{else if .Calendars}}
+<form method="post" action="/add">
+<div class="calendars">
+{{range $i, $cal := .Calendars}}<label><input type="radio" name="calendar" value="{{$cal.ID}}"{{if eq $i 0}} checked{{end}}><span class="dot" style="background-color: {{$cal.Colour}}"></span>{{$cal.Name}}</label>
+{{end}}
+</div>
+<label>What and when
+<input type="text" name="text" autocomplete="off" placeholder="Dentist Tue 3pm"></label>
+<button type="submit">Add</button>
+<p class="or">or fill in</p>
+<label>Title <input type="text" name="title" autocomplete="off"></label>
+<label>Day <input type="date" name="date" value="{{.Today}}"></label>
+<label>Time <input type="time" name="time"></label>
+<label>Length <select name="length">{{range .Lengths}}<option{{if eq .Minutes 60}} selected{{end}}>{{.Label}}</option>{{end}}</select></label>
+<button type="submit">Add</button>
+</form>
+{{else}}
+<p>There are no Google calendars in config.json to add events to.</p>
+{{end}}
+</body>
+</html>
+`))
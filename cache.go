@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// cacheEntry records the source photo a cached copy was made from.  The
+// source is only re-hashed when its modification time or size changes.
+type cacheEntry struct {
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+}
+
+// photoCache indexes the pre-scaled copies of the photos, keyed by path
+// relative to config.PhotosDir.  Copies are named by the source's content
+// hash and the display size, so a renamed photo isn't scaled again.
+var photoCache struct {
+	sync.Mutex
+	index map[string]cacheEntry
+}
+
+const cacheIndexName = "index.json"
+
+func startPhotoCache(config configStruct) {
+	if config.PhotoCacheDir == "" || config.DisplayWidth <= 0 || config.DisplayHeight <= 0 {
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: Photo cache disabled, photos are served full size\n")
+		return
+	}
+	if err := os.MkdirAll(config.PhotoCacheDir, 0755); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Creating "+config.PhotoCacheDir+": "+err.Error()+"\n")
+		return
+	}
+	loadCacheIndex(config)
+
+	runScheduled("PhotoCache", "", time.Minute*time.Duration(config.PhotoCacheInterval), checkInterval(config), func() {
+		updatePhotoCache(config)
+	})
+}
+
+// cacheEnabled reports whether startPhotoCache has set the cache up.
+func cacheEnabled(config configStruct) bool {
+	photoCache.Lock()
+	defer photoCache.Unlock()
+	return config.PhotoCacheDir != "" && photoCache.index != nil
+}
+
+// cachedPhoto returns the path of the pre-scaled copy of photo, or "" if
+// there isn't an up to date one.
+func cachedPhoto(config configStruct, photo string) string {
+	if config.PhotoCacheDir == "" {
+		return ""
+	}
+	info, err := os.Stat(filepath.Join(config.PhotosDir, filepath.FromSlash(photo)))
+	if err != nil {
+		return ""
+	}
+	photoCache.Lock()
+	entry, ok := photoCache.index[photo]
+	photoCache.Unlock()
+	if !ok || !entry.ModTime.Equal(info.ModTime()) || entry.Size != info.Size() {
+		return ""
+	}
+	cached := filepath.Join(config.PhotoCacheDir, cacheName(entry.Hash, config))
+	if _, err := os.Stat(cached); err != nil {
+		return ""
+	}
+	return cached
+}
+
+// updatePhotoCache scales every photo not yet in the cache, then removes
+// copies whose source photo has gone.
+func updatePhotoCache(config configStruct) {
+	photos := indexedPhotos(config)
+
+	scaled := 0
+	keep := make(map[string]bool)
+	present := make(map[string]bool)
+	for _, photo := range photos {
+		present[photo] = true
+		entry, made, err := cachePhoto(config, photo)
+		if err != nil {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Caching "+photo+": "+err.Error()+"\n")
+			continue
+		}
+		if made {
+			scaled++
+		}
+		keep[cacheName(entry.Hash, config)] = true
+	}
+
+	photoCache.Lock()
+	for photo := range photoCache.index {
+		if !present[photo] {
+			delete(photoCache.index, photo)
+		}
+	}
+	photoCache.Unlock()
+	saveCacheIndex(config)
+
+	removed := 0
+	files, err := ioutil.ReadDir(config.PhotoCacheDir)
+	if err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Error reading "+config.PhotoCacheDir+": "+err.Error()+"\n")
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == cacheIndexName || keep[f.Name()] {
+			continue
+		}
+		// Leave copies still being written alone
+		if strings.HasPrefix(f.Name(), scalingPrefix) && time.Since(f.ModTime()) < time.Hour {
+			continue
+		}
+		if err := os.Remove(filepath.Join(config.PhotoCacheDir, f.Name())); err == nil {
+			removed++
+		}
+	}
+
+	logger("photo", time.Now().Format(time.RFC850)+"  INFO: Photo cache: "+strconv.Itoa(len(keep))+" photos, "+strconv.Itoa(scaled)+" scaled, "+strconv.Itoa(removed)+" removed\n")
+}
+
+// cachePhoto makes sure photo has an up to date scaled copy, reporting
+// whether it had to make one.
+func cachePhoto(config configStruct, photo string) (cacheEntry, bool, error) {
+	src := filepath.Join(config.PhotosDir, filepath.FromSlash(photo))
+	info, err := os.Stat(src)
+	if err != nil {
+		return cacheEntry{}, false, err
+	}
+
+	photoCache.Lock()
+	entry, ok := photoCache.index[photo]
+	photoCache.Unlock()
+	if !ok || !entry.ModTime.Equal(info.ModTime()) || entry.Size != info.Size() {
+		hash, err := hashFile(src)
+		if err != nil {
+			return cacheEntry{}, false, err
+		}
+		entry = cacheEntry{ModTime: info.ModTime(), Size: info.Size(), Hash: hash}
+	}
+
+	scaled := false
+	dest := filepath.Join(config.PhotoCacheDir, cacheName(entry.Hash, config))
+	if _, err := os.Stat(dest); err != nil {
+		if err := scalePhoto(src, dest, config); err != nil {
+			return entry, false, err
+		}
+		scaled = true
+	}
+
+	photoCache.Lock()
+	photoCache.index[photo] = entry
+	photoCache.Unlock()
+	return entry, scaled, nil
+}
+
+// scalePhoto writes an upright JPEG copy of src to dest, no larger than is
+// needed to fill the display, or to fit it for photos that will be shown
+// whole or paired.  Photos are never scaled up.
+func scalePhoto(src string, dest string, config configStruct) error {
+	meta, err := readPhotoMeta(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	sx := float64(config.DisplayWidth) / float64(meta.Width)
+	sy := float64(config.DisplayHeight) / float64(meta.Height)
+	scale := math.Min(sx, sy)
+	if suitsDisplay(meta, config) {
+		scale = math.Max(sx, sy)
+	}
+	scale = math.Min(scale, 1)
+
+	// Scale before turning upright, as rotating the full-size photo is slow
+	w, h := int(float64(meta.Width)*scale+0.5), int(float64(meta.Height)*scale+0.5)
+	if meta.Orientation >= 5 {
+		w, h = h, w
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	// Each copy is written to a file of its own, as the same photo can be
+	// scaled twice at once, say by an upload and the watcher noticing it
+	out, err := ioutil.TempFile(filepath.Dir(dest), scalingPrefix+"*.jpg")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	err = jpeg.Encode(out, orientImage(scaled, meta.Orientation), &jpeg.Options{Quality: 85})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// scalingPrefix starts the names of scaled copies still being written.
+const scalingPrefix = ".scaling-"
+
+func cacheName(hash string, config configStruct) string {
+	return fmt.Sprintf("%s-%dx%d.jpg", hash, config.DisplayWidth, config.DisplayHeight)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+func loadCacheIndex(config configStruct) {
+	photoCache.Lock()
+	defer photoCache.Unlock()
+	photoCache.index = make(map[string]cacheEntry)
+
+	path := filepath.Join(config.PhotoCacheDir, cacheIndexName)
+	indexBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+path+"\n")
+		}
+		return
+	}
+	if err := json.Unmarshal(indexBytes, &photoCache.index); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Error unmarshaling "+path+"\n")
+		photoCache.index = make(map[string]cacheEntry)
+	}
+}
+
+func saveCacheIndex(config configStruct) {
+	photoCache.Lock()
+	indexBytes, err := json.MarshalIndent(photoCache.index, "", "    ")
+	photoCache.Unlock()
+	if err != nil {
+		return
+	}
+	path := filepath.Join(config.PhotoCacheDir, cacheIndexName)
+	if err := ioutil.WriteFile(path, indexBytes, 0644); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: WriteFile failed on "+path+"\n")
+	}
+}
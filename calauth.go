@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	calendar "google.golang.org/api/calendar/v3"
+)
+
+const (
+	clientSecretFile = "client_secret.json"
+	tokenFile        = "token.json"
+)
+
+// errNeedsAuth is returned by getClient while there is no usable token.
+// The planner then waits for someone to sign in, from /auth or with the
+// device flow, rather than exiting.
+var errNeedsAuth = errors.New("Google Calendar is not authorized yet")
+
+// calendarAuth tracks a sign-in in progress.  state guards the /auth
+// callback against requests the planner didn't start.
+var calendarAuth struct {
+	sync.Mutex
+	state   string
+	waiting bool
+	device  bool
+}
+
+// calendarOAuthConfig reads client_secret.json for the calendar scopes the
+// planner needs.
+func calendarOAuthConfig(config configStruct) (*oauth2.Config, error) {
+	b, err := ioutil.ReadFile(clientSecretFile)
+	if err != nil {
+		return nil, errors.New("Unable to read client secret file: " + err.Error())
+	}
+	// If modifying these scopes, delete your previously saved token.json.
+	// Adding events needs permission to change them, so is only asked for
+	// when it is turned on.
+	scope := calendar.CalendarReadonlyScope
+	if config.CalendarAddEvents {
+		scope = calendar.CalendarEventsScope
+	}
+	oauthConfig, err := google.ConfigFromJSON(b, scope)
+	if err != nil {
+		return nil, errors.New("Unable to parse client secret file to config: " + err.Error())
+	}
+	if oauthConfig.Endpoint.DeviceAuthURL == "" {
+		oauthConfig.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+	oauthConfig.RedirectURL = authRedirectURL(config)
+	return oauthConfig, nil
+}
+
+// authRedirectURL is where Google sends the browser after signing in.  It
+// is always on localhost, as Google only allows plain http there, so it
+// only loads in a browser on the planner itself; from a phone the address
+// is pasted into /auth instead.
+func authRedirectURL(config configStruct) string {
+	port := "8080"
+	if _, p, err := net.SplitHostPort(config.HTTPAddr); err == nil && p != "" {
+		port = p
+	}
+	return "http://localhost:" + port + "/auth/callback"
+}
+
+// startCalendarAuth asks for someone to sign in to Google, either with the
+// device flow, showing a code on the planner's screen, or by visiting
+// /auth on the planner's web server.
+func startCalendarAuth(config configStruct, oauthConfig *oauth2.Config) {
+	calendarAuth.Lock()
+	defer calendarAuth.Unlock()
+	if calendarAuth.waiting {
+		return
+	}
+	calendarAuth.waiting = true
+	calendarAuth.state = randomState()
+
+	if config.CalendarAuth == "device" {
+		calendarAuth.device = true
+		go deviceAuth(config, oauthConfig)
+		return
+	}
+	calendarAuth.device = false
+	logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Google Calendar needs authorizing, visit /auth on the planner's web server\n")
+	publishSticky("auth", authPrompt{Message: "Connect Google Calendar: open this planner's address followed by /auth on your phone"})
+}
+
+// authPrompt is shown on the planner's screen while a sign-in is needed.
+type authPrompt struct {
+	Message string `json:"message"`
+	URL     string `json:"url,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// deviceAuth runs the OAuth device flow: the planner shows a code, which
+// is entered at Google's device page from a phone.  Google only allows
+// this for clients of type "TVs and Limited Input devices".
+func deviceAuth(config configStruct, oauthConfig *oauth2.Config) {
+	ctx := context.Background()
+	for {
+		da, err := oauthConfig.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+		if err != nil {
+			logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Starting device sign-in: "+err.Error()+"\n")
+			publishSticky("auth", authPrompt{Message: "Google Calendar sign-in failed, see log/calendar.log"})
+			calendarAuth.Lock()
+			calendarAuth.waiting = false
+			calendarAuth.Unlock()
+			return
+		}
+		logger("calendar", time.Now().Format(time.RFC850)+"  INFO: To authorize Google Calendar go to "+da.VerificationURI+" and enter "+da.UserCode+"\n")
+		publishSticky("auth", authPrompt{Message: "Connect Google Calendar: on your phone go to", URL: da.VerificationURI, Code: da.UserCode})
+
+		tok, err := oauthConfig.DeviceAccessToken(ctx, da)
+		if err != nil {
+			// Usually the code expired before anyone used it
+			logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Device sign-in ended: "+err.Error()+", starting again\n")
+			continue
+		}
+		if err := finishCalendarAuth(config, tok); err != nil {
+			// The token can't be kept, so someone has to sign in again
+			logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Device sign-in couldn't be finished: "+err.Error()+", starting again\n")
+			calendarAuth.Lock()
+			calendarAuth.waiting = false
+			calendarAuth.state = ""
+			calendarAuth.Unlock()
+			startCalendarAuth(config, oauthConfig)
+		}
+		return
+	}
+}
+
+// finishCalendarAuth saves a new token and loads the calendar with it.
+func finishCalendarAuth(config configStruct, tok *oauth2.Token) error {
+	if err := saveToken(tokenFile, tok); err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Unable to save "+tokenFile+": "+err.Error()+"\n")
+		return err
+	}
+	calendarAuth.Lock()
+	calendarAuth.waiting = false
+	calendarAuth.state = ""
+	calendarAuth.Unlock()
+	publishSticky("auth", authPrompt{})
+	logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Google Calendar authorized, token saved to "+tokenFile+"\n")
+	go getCalendar(config)
+	return nil
+}
+
+func randomState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleCalendarAuth adds the Google sign-in pages to mux.  They only do
+// anything while the planner is waiting for a sign-in, so nobody can swap
+// in their own account later.
+func handleCalendarAuth(mux *http.ServeMux, config configStruct) {
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		msg := ""
+		if r.Method == http.MethodPost {
+			if err := exchangeAuthCode(config, r.FormValue("response")); err != nil {
+				msg = err.Error()
+			} else {
+				msg = "Google Calendar is connected."
+			}
+		}
+		showAuthPage(w, config, msg)
+	})
+	mux.HandleFunc("/auth/callback", func(w http.ResponseWriter, r *http.Request) {
+		msg := "Google Calendar is connected."
+		if err := exchangeAuthCode(config, r.URL.String()); err != nil {
+			msg = err.Error()
+		}
+		showAuthPage(w, config, msg)
+	})
+}
+
+// exchangeAuthCode trades the code Google gave the browser for a token.
+// response is the address the browser was sent to, which carries the code
+// and state.  A code on its own isn't accepted, as without the state it
+// could be from anyone's sign-in.
+func exchangeAuthCode(config configStruct, response string) error {
+	calendarAuth.Lock()
+	waiting, device, state := calendarAuth.waiting, calendarAuth.device, calendarAuth.state
+	calendarAuth.Unlock()
+	if !waiting || device {
+		return errors.New("The planner isn't waiting for a Google sign-in.")
+	}
+
+	u, err := url.Parse(strings.TrimSpace(response))
+	if err != nil || u.Query().Get("code") == "" {
+		return errors.New("Paste the whole address of the page Google sent you to.")
+	}
+	if state == "" || u.Query().Get("state") != state {
+		return errors.New("That sign-in has expired, please start again.")
+	}
+	code := u.Query().Get("code")
+
+	oauthConfig, err := calendarOAuthConfig(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tok, err := oauthConfig.Exchange(ctx, code)
+	if err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Unable to retrieve token from web: "+err.Error()+"\n")
+		return errors.New("Google didn't accept that code, please start again.")
+	}
+	if err := finishCalendarAuth(config, tok); err != nil {
+		return errors.New("The planner couldn't save the token.")
+	}
+	return nil
+}
+
+func showAuthPage(w http.ResponseWriter, config configStruct, msg string) {
+	calendarAuth.Lock()
+	page := struct {
+		Message string
+		Waiting bool
+		Device  bool
+		AuthURL string
+	}{Message: msg, Waiting: calendarAuth.waiting, Device: calendarAuth.device}
+	state := calendarAuth.state
+	calendarAuth.Unlock()
+
+	if page.Waiting && !page.Device {
+		if oauthConfig, err := calendarOAuthConfig(config); err == nil {
+			page.AuthURL = oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+		} else {
+			page.Message = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := authPage.Execute(w, page); err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Rendering auth page: "+err.Error()+"\n")
+	}
+}
+
+var authPage = template.Must(template.New("auth").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Planner Calendar</title>
+<style>
+body { font-family: sans-serif; margin: 1rem; background: #1b2a41; color: white; }
+a { color: #9cf; }
+input, button { font-size: 1.1rem; margin: 0.3rem 0; width: 100%; }
+.msg { background: rgba(255, 255, 255, 0.15); padding: 0.5rem; border-radius: 0.4rem; }
+</style>
+</head>
+<body>
+<h1>Planner Calendar</h1>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+{{if .AuthURL}}
+<p>1. <a href="{{.AuthURL}}">Sign in with Google</a> and allow the planner to read your calendar.</p>
+<p>2. Google then sends you to a <i>localhost</i> page.  On a phone that page won't load; copy its address from the address bar and paste it here.</p>
+<form method="post" action="/auth">
+<input type="text" name="response" autocomplete="off" placeholder="http://localhost:8080/auth/callback?...">
+<button type="submit">Connect</button>
+</form>
+{{else if .Device}}
+<p>Follow the instructions on the planner's screen to connect Google Calendar.</p>
+{{else if not .Message}}
+<p>Google Calendar is connected.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	calendar "google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// cachedCalendar is what is kept of a Google calendar between refreshes:
+// its events, and the sync token that asks Google for only what has
+// changed since.
+type cachedCalendar struct {
+	SyncToken        string                   `json:"syncToken"`
+	DefaultReminders []time.Duration          `json:"defaultReminders"`
+	Events           map[string]calendarEvent `json:"events"`
+}
+
+// calendarCache holds every Google calendar's cachedCalendar, keyed by
+// calendar ID, and is saved to config.CalendarCacheFile after each sync so
+// a restart doesn't start from scratch.
+var calendarCache struct {
+	sync.Mutex
+	loaded    bool
+	calendars map[string]cachedCalendar
+}
+
+// googleSyncPage is how many events are asked for at a time.
+const googleSyncPage = 2500
+
+// syncGoogleCalendar brings the cached copy of a Google calendar up to
+// date and returns its events.  The first sync fetches every event that
+// hasn't ended yet; after that only the changes are fetched.
+func syncGoogleCalendar(config configStruct, srv *calendar.Service, cal calendarConfig) ([]calendarEvent, error) {
+	cached := cachedGoogleCalendar(config, cal.ID)
+	events := cached.Events
+	full := cached.SyncToken == "" || events == nil
+	if full {
+		events = make(map[string]calendarEvent)
+	}
+	token, pageToken := cached.SyncToken, ""
+	defaults := cached.DefaultReminders
+	changes := 0
+	for {
+		call := srv.Events.List(cal.ID).SingleEvents(true).MaxResults(googleSyncPage)
+		if full {
+			call = call.TimeMin(time.Now().Format(time.RFC3339))
+		} else {
+			call = call.SyncToken(token)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		resp, err := call.Do()
+		if err != nil {
+			var apiErr *googleapi.Error
+			if !full && errors.As(err, &apiErr) && apiErr.Code == http.StatusGone {
+				// Google has forgotten the sync token, so start again
+				logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Sync token for "+cal.Name+" expired, fetching all events\n")
+				full, token, pageToken = true, "", ""
+				events = make(map[string]calendarEvent)
+				continue
+			}
+			return nil, err
+		}
+		if pageToken == "" {
+			defaults = popupReminders(resp.DefaultReminders)
+		}
+		for _, item := range resp.Items {
+			changes++
+			if item.Status == "cancelled" {
+				// A cancelled recurring event takes its occurrences with it
+				for id := range events {
+					if id == item.Id || strings.HasPrefix(id, item.Id+"_") {
+						delete(events, id)
+					}
+				}
+				continue
+			}
+			events[item.Id] = googleEvent(item, defaults)
+		}
+		if resp.NextPageToken == "" {
+			token = resp.NextSyncToken
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	// Events that have ended are no use to anyone
+	now := time.Now()
+	for id, e := range events {
+		if !e.End.After(now) {
+			delete(events, id)
+		}
+	}
+	if full {
+		logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Fetched all "+strconv.Itoa(len(events))+" events of "+cal.Name+"\n")
+	} else if changes > 0 {
+		logger("calendar", time.Now().Format(time.RFC850)+"  INFO: "+strconv.Itoa(changes)+" events of "+cal.Name+" changed\n")
+	}
+
+	storeGoogleCalendar(config, cal.ID, cachedCalendar{SyncToken: token, DefaultReminders: defaults, Events: events})
+	var list []calendarEvent
+	for _, e := range events {
+		e.Calendar = cal
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// cachedGoogleEvents returns the events kept of a calendar from its last
+// sync, for when Google can't be reached.
+func cachedGoogleEvents(config configStruct, cal calendarConfig) []calendarEvent {
+	var list []calendarEvent
+	now := time.Now()
+	for _, e := range cachedGoogleCalendar(config, cal.ID).Events {
+		if e.End.After(now) {
+			e.Calendar = cal
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// googleEvent converts an event from the Calendar API.
+func googleEvent(item *calendar.Event, defaults []time.Duration) calendarEvent {
+	reminders := defaults
+	if item.Reminders != nil && !item.Reminders.UseDefault {
+		reminders = popupReminders(item.Reminders.Overrides)
+	}
+	return calendarEvent{
+		ID:        item.Id,
+		Summary:   item.Summary,
+		Location:  item.Location,
+		Start:     eventStart(item.Start),
+		End:       eventStart(item.End),
+		AllDay:    item.Start != nil && item.Start.DateTime == "",
+		Reminders: reminders,
+	}
+}
+
+// cachedGoogleCalendar returns a copy of what is cached of a calendar,
+// reading config.CalendarCacheFile the first time.
+func cachedGoogleCalendar(config configStruct, id string) cachedCalendar {
+	calendarCache.Lock()
+	defer calendarCache.Unlock()
+	if !calendarCache.loaded {
+		calendarCache.loaded = true
+		calendarCache.calendars = make(map[string]cachedCalendar)
+		loadCalendarCache(config)
+	}
+	cached := calendarCache.calendars[id]
+	events := make(map[string]calendarEvent, len(cached.Events))
+	for k, e := range cached.Events {
+		events[k] = e
+	}
+	if cached.Events != nil {
+		cached.Events = events
+	}
+	return cached
+}
+
+func storeGoogleCalendar(config configStruct, id string, cached cachedCalendar) {
+	calendarCache.Lock()
+	calendarCache.calendars[id] = cached
+	calendarCache.Unlock()
+	saveCalendarCache(config)
+}
+
+// loadCalendarCache reads config.CalendarCacheFile.  calendarCache must be
+// locked.
+func loadCalendarCache(config configStruct) {
+	if config.CalendarCacheFile == "" {
+		return
+	}
+	cacheBytes, err := ioutil.ReadFile(config.CalendarCacheFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+config.CalendarCacheFile+"\n")
+		}
+		return
+	}
+	if err := json.Unmarshal(cacheBytes, &calendarCache.calendars); err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Error unmarshaling "+config.CalendarCacheFile+"\n")
+		calendarCache.calendars = make(map[string]cachedCalendar)
+	}
+}
+
+func saveCalendarCache(config configStruct) {
+	if config.CalendarCacheFile == "" {
+		return
+	}
+	calendarCache.Lock()
+	cacheBytes, err := json.MarshalIndent(calendarCache.calendars, "", "    ")
+	calendarCache.Unlock()
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(config.CalendarCacheFile, cacheBytes, 0600); err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: WriteFile failed on "+config.CalendarCacheFile+"\n")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	calendar "google.golang.org/api/calendar/v3"
+)
+
+// calendarConfig is one calendar listed in config.Calendars: where its
+// events come from, the name shown for it and the colour its events are
+// tagged with.  Type is "google" (the default), with ID its Google calendar
+// ID; "ics", with URL an iCalendar address or file; or "caldav", with URL
+// the calendar's address on a CalDAV server.  Username and Password are
+// sent to ICS and CalDAV servers that need them.  Reminders, in minutes
+// before each event, replace config.ReminderMinutes for this calendar.
+type calendarConfig struct {
+	Type               string `json:"type"`
+	ID                 string `json:"id"`
+	URL                string `json:"url"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	Name               string `json:"name"`
+	Colour             string `json:"colour"`
+	Reminders          []int  `json:"reminders"`
+	IgnoreOwnReminders bool   `json:"ignoreEventReminders"`
+}
+
+// calendarColours are given, in turn, to calendars configured without a
+// colour.
+var calendarColours = []string{"#4285f4", "#db4437", "#f4b400", "#0f9d58", "#ab47bc", "#00acc1", "#ff7043", "#9e9d24"}
+
+// cssColour matches the colours accepted in config.Calendars: hex colours
+// and CSS colour names.  Anything else could break out of the style
+// attribute it is written into.
+var cssColour = regexp.MustCompile(`^(#[0-9A-Fa-f]{3,8}|[A-Za-z]+)$`)
+
+// calendarsToShow returns config.Calendars with names and colours filled
+// in, or just the primary calendar if none are configured.
+func calendarsToShow(config configStruct) []calendarConfig {
+	calendars := config.Calendars
+	if len(calendars) == 0 {
+		calendars = []calendarConfig{{ID: "primary"}}
+	}
+	shown := make([]calendarConfig, 0, len(calendars))
+	for i, cal := range calendars {
+		if cal.Type == "ics" || cal.Type == "caldav" {
+			if cal.URL == "" {
+				continue
+			}
+			if cal.Name == "" {
+				cal.Name = cal.URL
+			}
+		} else {
+			if cal.ID == "" {
+				continue
+			}
+			if cal.Name == "" {
+				cal.Name = cal.ID
+				if cal.ID == "primary" {
+					cal.Name = "Family"
+				}
+			}
+		}
+		if !cssColour.MatchString(cal.Colour) {
+			cal.Colour = calendarColours[i%len(calendarColours)]
+		}
+		shown = append(shown, cal)
+	}
+	return shown
+}
+
+// eventStart returns when an event starts in local time.  All-day events
+// have only a date and start at local midnight.
+func eventStart(dt *calendar.EventDateTime) time.Time {
+	if dt == nil {
+		return time.Time{}
+	}
+	if dt.DateTime != "" {
+		if t, err := time.Parse(time.RFC3339, dt.DateTime); err == nil {
+			return t.Local()
+		}
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Error in time.Parse(): "+dt.DateTime+"\n")
+	}
+	t, err := time.ParseInLocation("2006-01-02", dt.Date, time.Local)
+	if err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Error in time.Parse(): "+dt.Date+"\n")
+	}
+	return t
+}
+
+// Unless config.CalendarEvents and config.CalendarDays say otherwise, the
+// list shows the next 10 events in the coming year.  Recurring events in
+// ICS and CalDAV calendars are only expanded as far ahead as are shown.
+const (
+	defaultCalendarEvents = 10
+	defaultCalendarDays   = 366
+)
+
+func calendarEvents(config configStruct) int {
+	if config.CalendarEvents <= 0 {
+		return defaultCalendarEvents
+	}
+	return config.CalendarEvents
+}
+
+func calendarDays(config configStruct) int {
+	if config.CalendarDays <= 0 {
+		return defaultCalendarDays
+	}
+	return config.CalendarDays
+}
+
+// eventList renders events as the items of the events list, grouped under
+// a heading for each day, or a message saying there are none.  Events in
+// progress go under today's heading, and timed ones are marked "now".
+// Each event's start and end are kept in data attributes, so the page can
+// keep that up to date between refreshes.
+func eventList(events []calendarEvent, days int, now time.Time) string {
+	if len(events) == 0 {
+		when := "the next " + strconv.Itoa(days) + " days"
+		if days == 1 {
+			when = "the next day"
+		}
+		return "<li class=\"noEvents\">Nothing on the calendar in " + when + "</li>"
+	}
+	var list strings.Builder
+	heading := ""
+	for _, e := range events {
+		day := e.Start
+		if day.Before(now) {
+			day = now
+		}
+		if h := dayHeading(day, now); h != heading {
+			heading = h
+			list.WriteString("<li class=\"eventDay\">" + h + "</li>")
+		}
+		class := "event"
+		switch {
+		case e.AllDay:
+			class += " allDay"
+		case !e.Start.After(now) && e.End.After(now):
+			class += " now"
+		}
+		fmt.Fprintf(&list, "<li class=\"%s\" data-start=\"%d\" data-end=\"%d\">%s<span class=\"eventTime\">%s</span> <span class=\"eventSummary\">%s</span></li>",
+			class, e.Start.Unix()*1000, e.End.Unix()*1000, calendarDot(e.Calendar), eventTime(e), html.EscapeString(e.Summary))
+	}
+	return list.String()
+}
+
+// dayHeading names day as seen from now: "Today", "Tomorrow", the weekday
+// for the rest of the coming week, and the date after that.
+func dayHeading(day time.Time, now time.Time) string {
+	today := startOfDay(now)
+	switch {
+	case sameDay(day, today):
+		return "Today"
+	case sameDay(day, today.AddDate(0, 0, 1)):
+		return "Tomorrow"
+	case day.Before(today.AddDate(0, 0, 7)):
+		return day.Format("Monday")
+	}
+	return day.Format("Monday, January 2")
+}
+
+// eventTime says when an event is, the day being given by its heading:
+// "all day", a span of days for longer all-day events, or its start and
+// end times, with weekdays if it runs past midnight.
+func eventTime(e calendarEvent) string {
+	if e.AllDay {
+		last := e.End.AddDate(0, 0, -1)
+		if !last.After(e.Start) {
+			return "all day"
+		}
+		return e.Start.Format("Mon Jan 2") + " &ndash; " + last.Format("Mon Jan 2")
+	}
+	if !e.End.After(e.Start) {
+		return e.Start.Format("3:04pm")
+	}
+	if sameDay(e.Start, e.End.Add(-time.Nanosecond)) {
+		return e.Start.Format("3:04pm") + " &ndash; " + e.End.Format("3:04pm")
+	}
+	return e.Start.Format("Mon 3:04pm") + " &ndash; " + e.End.Format("Mon 3:04pm")
+}
+
+// nextEvent says which event starts next and how long it is until then.
+// The page counts it down from there.
+func nextEvent(events []calendarEvent, now time.Time) string {
+	for _, e := range events {
+		if e.Start.After(now) {
+			return "Next: " + html.EscapeString(e.Summary) + " " + countdown(e.Start.Sub(now))
+		}
+	}
+	return ""
+}
+
+// countdown is the same as countdown() in js/planner.js.
+func countdown(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	switch {
+	case minutes <= 1:
+		return "in a minute"
+	case minutes < 60:
+		return "in " + strconv.Itoa(minutes) + " min"
+	case minutes < 24*60:
+		return "in " + strconv.Itoa(minutes/60) + "h " + strconv.Itoa(minutes%60) + "m"
+	}
+	days := minutes / (24 * 60)
+	if days == 1 {
+		return "in 1 day"
+	}
+	return "in " + strconv.Itoa(days) + " days"
+}
+
+// overlaps reports whether e is on at any time from from until to.  An
+// event with no length counts if it is at from.
+func overlaps(e calendarEvent, from time.Time, to time.Time) bool {
+	return (e.End.After(from) && e.Start.Before(to)) || e.Start.Equal(from)
+}
+
+// sortEvents puts events in order of their start times.
+func sortEvents(events []calendarEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+}
+
+// calendarDot is the coloured tag put before each event.
+func calendarDot(cal calendarConfig) string {
+	return "<span class=\"calendarDot\" style=\"background-color: " + cal.Colour + "\" title=\"" + html.EscapeString(cal.Name) + "\"></span>"
+}
+
+// calendarLegend names the colour of each calendar, when there is more than
+// one.
+func calendarLegend(config configStruct) string {
+	calendars := calendarsToShow(config)
+	if len(calendars) < 2 {
+		return ""
+	}
+	var legend []string
+	for _, cal := range calendars {
+		legend = append(legend, "<span class=\"calendarName\">"+calendarDot(cal)+html.EscapeString(cal.Name)+"</span>")
+	}
+	return strings.Join(legend, " ")
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	calendar "google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// calendarEvent is one event, or one occurrence of a recurring event, from
+// any kind of calendar, with its times in local time.  End is exclusive;
+// for all-day events it is the midnight after the last day.
+type calendarEvent struct {
+	ID       string
+	Summary  string
+	Location string
+	Start    time.Time
+	End      time.Time
+	AllDay   bool
+	Calendar calendarConfig `json:"-"`
+
+	// Reminders are the event's own reminders, as how long before it
+	// starts they are due.
+	Reminders []time.Duration
+}
+
+// calendarSource is where a calendar's events come from: Google Calendar,
+// a CalDAV server, or an iCalendar file on the web or on disk.
+type calendarSource interface {
+	// Calendar is the calendar's entry in config.Calendars.
+	Calendar() calendarConfig
+
+	// Events returns up to max of the events overlapping from to to, sorted
+	// by start time.  If the calendar can't be read, Events may return
+	// events it has kept from before along with the error.
+	Events(from time.Time, to time.Time, max int) ([]calendarEvent, error)
+}
+
+// calendarSources returns a source for each calendar in config.Calendars.
+func calendarSources(config configStruct) []calendarSource {
+	var sources []calendarSource
+	var srv *calendar.Service
+	var srvErr error
+	for _, cal := range calendarsToShow(config) {
+		switch cal.Type {
+		case "ics":
+			sources = append(sources, icsSource{cal: cal})
+		case "caldav":
+			sources = append(sources, caldavSource{cal: cal})
+		default:
+			if srv == nil && srvErr == nil {
+				srv, srvErr = googleService(config)
+			}
+			sources = append(sources, googleSource{config: config, srv: srv, cal: cal, err: srvErr})
+		}
+	}
+	return sources
+}
+
+// googleService connects to Google Calendar, starting a sign-in if there
+// is no token yet.
+func googleService(config configStruct) (*calendar.Service, error) {
+	oauthConfig, err := calendarOAuthConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(config, oauthConfig)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := calendar.New(client)
+	if err != nil {
+		return nil, errors.New("Unable to retrieve Calendar client: " + err.Error())
+	}
+	return srv, nil
+}
+
+// googleSource is a Google calendar, cal.ID being its calendar ID.  Its
+// events are kept in calendarCache and only the changes fetched each time.
+// err is why Google Calendar couldn't be connected to, if it couldn't.
+type googleSource struct {
+	config configStruct
+	srv    *calendar.Service
+	cal    calendarConfig
+	err    error
+}
+
+func (s googleSource) Calendar() calendarConfig { return s.cal }
+
+// Events returns the calendar's events, or those cached from before if
+// Google can't be reached.  When Google no longer accepts the saved token,
+// as happens when someone revokes the planner's access, the token is
+// deleted and a new sign-in started.
+func (s googleSource) Events(from time.Time, to time.Time, max int) ([]calendarEvent, error) {
+	err := s.err
+	var events []calendarEvent
+	if err == nil {
+		events, err = syncGoogleCalendar(s.config, s.srv, s.cal)
+	}
+	if err != nil {
+		if authExpired(err) {
+			logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Google no longer accepts "+tokenFile+", asking to sign in again: "+err.Error()+"\n")
+			os.Remove(tokenFile)
+			if oauthConfig, cerr := calendarOAuthConfig(s.config); cerr == nil {
+				startCalendarAuth(s.config, oauthConfig)
+			}
+			err = errNeedsAuth
+		}
+		events = cachedGoogleEvents(s.config, s.cal)
+	}
+	var found []calendarEvent
+	for _, e := range events {
+		if overlaps(e, from, to) {
+			found = append(found, e)
+		}
+	}
+	return firstEvents(found, max), err
+}
+
+// authExpired reports whether err means Google has refused the planner's
+// token, rather than just being unreachable.
+func authExpired(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.ErrorCode == "invalid_grant" || retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized
+	}
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
+
+// popupReminders returns when Google Calendar's popup reminders are due.
+// Email reminders are left to Google.
+func popupReminders(list []*calendar.EventReminder) []time.Duration {
+	var due []time.Duration
+	for _, r := range list {
+		if r != nil && r.Method == "popup" {
+			due = append(due, time.Duration(r.Minutes)*time.Minute)
+		}
+	}
+	return due
+}
+
+// icsSource is an iCalendar file: cal.URL is an http, https or webcal
+// address, such as a calendar's "secret address in iCal format", or the
+// path of a local .ics file.
+type icsSource struct {
+	cal calendarConfig
+}
+
+func (s icsSource) Calendar() calendarConfig { return s.cal }
+
+func (s icsSource) Events(from time.Time, to time.Time, max int) ([]calendarEvent, error) {
+	address := s.cal.URL
+	if strings.HasPrefix(address, "webcal://") {
+		address = "https://" + strings.TrimPrefix(address, "webcal://")
+	}
+
+	var body io.ReadCloser
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		req, err := http.NewRequest(http.MethodGet, address, nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.cal.Username != "" {
+			req.SetBasicAuth(s.cal.Username, s.cal.Password)
+		}
+		resp, err := calendarHTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New(resp.Status)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(strings.TrimPrefix(address, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	events, err := icsEvents(body, s.cal, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return firstEvents(events, max), nil
+}
+
+// caldavSource is a calendar on a CalDAV server such as Nextcloud, Fastmail
+// or iCloud: cal.URL is the calendar's collection address, and Username and
+// Password are sent with basic authentication.  Use an app password where
+// the server offers them.
+type caldavSource struct {
+	cal calendarConfig
+}
+
+func (s caldavSource) Calendar() calendarConfig { return s.cal }
+
+// caldavQuery asks for the VEVENTs overlapping a time range (RFC 4791).
+// Recurring events come back whole and are expanded by icsEvents.
+const caldavQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%START%" end="%END%"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>
+`
+
+// caldavMultistatus is the part of a REPORT response the planner uses.
+type caldavMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Prop struct {
+				CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (s caldavSource) Events(from time.Time, to time.Time, max int) ([]calendarEvent, error) {
+	query := strings.NewReplacer("%START%", from.UTC().Format("20060102T150405Z"),
+		"%END%", to.UTC().Format("20060102T150405Z")).Replace(caldavQuery)
+	req, err := http.NewRequest("REPORT", s.cal.URL, strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if s.cal.Username != "" {
+		req.SetBasicAuth(s.cal.Username, s.cal.Password)
+	}
+	resp, err := calendarHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, errors.New(resp.Status)
+	}
+
+	var ms caldavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	var events []calendarEvent
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if ps.Prop.CalendarData == "" {
+				continue
+			}
+			found, err := icsEvents(strings.NewReader(ps.Prop.CalendarData), s.cal, from, to)
+			if err != nil {
+				logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Skipping an event in "+s.cal.Name+": "+err.Error()+"\n")
+				continue
+			}
+			events = append(events, found...)
+		}
+	}
+	return firstEvents(events, max), nil
+}
+
+// calendarHTTP fetches ICS and CalDAV calendars.
+var calendarHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// firstEvents sorts events by start time and keeps the first max.
+func firstEvents(events []calendarEvent, max int) []calendarEvent {
+	sortEvents(events)
+	if max > 0 && len(events) > max {
+		events = events[:max]
+	}
+	return events
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// calendarRefresh stops getCalendar running twice at once, as it can be
+// started by the schedule, a retry or a finished sign-in.
+var calendarRefresh sync.Mutex
+
+// The first retry of a failing calendar is after calendarRetryFirst, and
+// each one after waits twice as long, up to calendarRetryMax.
+const (
+	calendarRetryFirst = time.Minute
+	calendarRetryMax   = 30 * time.Minute
+)
+
+// calendarFailure is a calendar that couldn't be read, and since when.
+type calendarFailure struct {
+	cal       calendarConfig
+	since     time.Time
+	needsAuth bool
+}
+
+// calendarHealth keeps the calendars that are failing, the events each
+// calendar last returned so they can still be shown while it fails, and
+// the retry waiting to run.
+var calendarHealth struct {
+	sync.Mutex
+	failing    map[string]calendarFailure
+	lastGood   map[string][]calendarEvent
+	retry      *time.Timer
+	retryDelay time.Duration
+}
+
+// calendarKey identifies a calendar across refreshes.
+func calendarKey(cal calendarConfig) string {
+	return cal.Type + " " + cal.ID + " " + cal.URL
+}
+
+// calendarRead records that a calendar was read, forgetting any failure.
+func calendarRead(cal calendarConfig, events []calendarEvent) {
+	calendarHealth.Lock()
+	defer calendarHealth.Unlock()
+	if calendarHealth.lastGood == nil {
+		calendarHealth.lastGood = make(map[string][]calendarEvent)
+	}
+	key := calendarKey(cal)
+	if f, ok := calendarHealth.failing[key]; ok {
+		logger("calendar", time.Now().Format(time.RFC850)+"  INFO: "+cal.Name+" is back, unavailable since "+f.since.Format(time.RFC850)+"\n")
+		delete(calendarHealth.failing, key)
+	}
+	calendarHealth.lastGood[key] = events
+}
+
+// calendarFailed records that a calendar couldn't be read, and returns the
+// events to show for it meanwhile: those the source kept, or else those it
+// last returned.
+func calendarFailed(cal calendarConfig, err error, kept []calendarEvent, from time.Time, to time.Time) []calendarEvent {
+	calendarHealth.Lock()
+	defer calendarHealth.Unlock()
+	if calendarHealth.failing == nil {
+		calendarHealth.failing = make(map[string]calendarFailure)
+	}
+	key := calendarKey(cal)
+	f, ok := calendarHealth.failing[key]
+	if !ok {
+		f = calendarFailure{cal: cal, since: time.Now()}
+	}
+	f.needsAuth = errors.Is(err, errNeedsAuth)
+	calendarHealth.failing[key] = f
+
+	if len(kept) > 0 {
+		return kept
+	}
+	var events []calendarEvent
+	for _, e := range calendarHealth.lastGood[key] {
+		if overlaps(e, from, to) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// calendarStatus says which calendars can't be read, for the events panel.
+func calendarStatus(now time.Time) string {
+	calendarHealth.Lock()
+	defer calendarHealth.Unlock()
+	var failures []calendarFailure
+	for _, f := range calendarHealth.failing {
+		failures = append(failures, f)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].cal.Name < failures[j].cal.Name
+	})
+
+	var status []string
+	for _, f := range failures {
+		text := f.cal.Name + " calendar needs signing in to Google"
+		if !f.needsAuth {
+			since := f.since.Format("3:04pm")
+			if !sameDay(f.since, now) {
+				since = f.since.Format("Mon 3:04pm")
+			}
+			text = f.cal.Name + " calendar unavailable since " + since
+		}
+		status = append(status, "<span class=\"calendarProblem\">"+calendarDot(f.cal)+html.EscapeString(text)+"</span>")
+	}
+	return strings.Join(status, "<br>")
+}
+
+// scheduleCalendarRetry refreshes the calendar again soon if any calendar
+// failed, waiting longer each time it fails again.  Calendars waiting for a
+// sign-in are refreshed when it finishes instead.
+func scheduleCalendarRetry(config configStruct) {
+	calendarHealth.Lock()
+	defer calendarHealth.Unlock()
+	retry := false
+	for _, f := range calendarHealth.failing {
+		retry = retry || !f.needsAuth
+	}
+	if !retry {
+		calendarHealth.retryDelay = 0
+		return
+	}
+	if calendarHealth.retry != nil {
+		return
+	}
+	calendarHealth.retryDelay *= 2
+	if calendarHealth.retryDelay == 0 {
+		calendarHealth.retryDelay = calendarRetryFirst
+	}
+	if calendarHealth.retryDelay > calendarRetryMax {
+		calendarHealth.retryDelay = calendarRetryMax
+	}
+	logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Trying the calendar again in "+calendarHealth.retryDelay.String()+"\n")
+	calendarHealth.retry = time.AfterFunc(calendarHealth.retryDelay, func() {
+		calendarHealth.Lock()
+		calendarHealth.retry = nil
+		calendarHealth.Unlock()
+		getCalendar(config)
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+// weekDays is how many days the week view shows, starting today.
+const weekDays = 7
+
+// The week view's time slots run from weekFirstHour to weekLastHour,
+// stretched to fit any earlier or later events.
+const (
+	weekFirstHour = 8
+	weekLastHour  = 20
+)
+
+// weekMaxEvents is the most events fetched from each calendar for the
+// week view.
+const weekMaxEvents = 250
+
+// weekMinLength is the shortest an event is drawn, so events without an
+// end time can still be read.
+const weekMinLength = 30 * time.Minute
+
+// weekBlock is the part of a timed event that falls on one day of the week
+// view.  col and cols place it side by side with events it overlaps.
+type weekBlock struct {
+	event calendarEvent
+	start time.Time
+	end   time.Time
+	col   int
+	cols  int
+}
+
+// startOfDay is the local midnight that begins now's day, from which the
+// week view and the day headings count.
+func startOfDay(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// weekGrid renders events as a grid of weekDays days from start.  All-day
+// events, and timed events lasting a day or more, run across the top;
+// other events are placed in time slots, with overlapping events side by
+// side.
+func weekGrid(events []calendarEvent, start time.Time, now time.Time) string {
+	var days []time.Time
+	for d := 0; d <= weekDays; d++ {
+		days = append(days, time.Date(start.Year(), start.Month(), start.Day()+d, 0, 0, 0, 0, time.Local))
+	}
+
+	var allDay []calendarEvent
+	blocks := make([][]weekBlock, weekDays)
+	first, last := weekFirstHour*60, weekLastHour*60
+	for _, e := range events {
+		if e.AllDay || e.End.Sub(e.Start) >= 24*time.Hour {
+			allDay = append(allDay, e)
+			continue
+		}
+		end := e.End
+		if end.Sub(e.Start) < weekMinLength {
+			end = e.Start.Add(weekMinLength)
+		}
+		for d := 0; d < weekDays; d++ {
+			s, f := e.Start, end
+			if s.Before(days[d]) {
+				s = days[d]
+			}
+			if f.After(days[d+1]) {
+				f = days[d+1]
+			}
+			if !s.Before(f) {
+				continue
+			}
+			blocks[d] = append(blocks[d], weekBlock{event: e, start: s, end: f})
+			if m := minuteOfDay(s, days[d]); m < first {
+				first = m
+			}
+			if m := minuteOfDay(f, days[d]); m > last {
+				last = m
+			}
+		}
+	}
+	first = first / 60 * 60
+	last = (last + 59) / 60 * 60
+
+	var b strings.Builder
+	b.WriteString("<div class=\"week\">")
+
+	b.WriteString("<div class=\"weekRow weekHeader\"><div class=\"weekGutter\"></div>")
+	for d := 0; d < weekDays; d++ {
+		b.WriteString("<div class=\"weekDay" + todayClass(days[d], now) + "\">" + days[d].Format("Mon 2") + "</div>")
+	}
+	b.WriteString("</div>")
+
+	b.WriteString("<div class=\"weekRow weekAllDay\"><div class=\"weekGutter\"></div>")
+	for _, e := range allDay {
+		if !e.Start.Before(days[weekDays]) || !e.End.After(days[0]) {
+			continue
+		}
+		from, to := dayIndex(e.Start, days), dayIndex(e.End.Add(-time.Nanosecond), days)
+		if from < 0 {
+			from = 0
+		}
+		if to < 0 {
+			to = weekDays - 1
+		}
+		fmt.Fprintf(&b, "<div class=\"weekEvent\" style=\"grid-column: %d / %d; background-color: %s\">%s</div>",
+			from+2, to+3, e.Calendar.Colour, html.EscapeString(e.Summary))
+	}
+	b.WriteString("</div>")
+
+	b.WriteString("<div class=\"weekRow weekTimes\"><div class=\"weekGutter\">")
+	span := float64(last - first)
+	for m := first; m < last; m += 60 {
+		fmt.Fprintf(&b, "<div class=\"weekHour\" style=\"top: %.2f%%\">%s</div>",
+			float64(m-first)*100/span, time.Date(days[0].Year(), days[0].Month(), days[0].Day(), 0, m, 0, 0, time.Local).Format("3pm"))
+	}
+	b.WriteString("</div>")
+	for d := 0; d < weekDays; d++ {
+		b.WriteString("<div class=\"weekColumn" + todayClass(days[d], now) + "\">")
+		layoutColumns(blocks[d])
+		for _, block := range blocks[d] {
+			top := float64(minuteOfDay(block.start, days[d])-first) * 100 / span
+			height := float64(minuteOfDay(block.end, days[d])-minuteOfDay(block.start, days[d])) * 100 / span
+			width := 100 / float64(block.cols)
+			fmt.Fprintf(&b, "<div class=\"weekEvent\" style=\"top: %.2f%%; height: %.2f%%; left: %.2f%%; width: %.2f%%; background-color: %s\"><span class=\"weekTime\">%s</span> %s</div>",
+				top, height, width*float64(block.col), width, block.event.Calendar.Colour,
+				block.event.Start.Format("3:04pm"), html.EscapeString(block.event.Summary))
+		}
+		b.WriteString("</div>")
+	}
+	b.WriteString("</div>")
+
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// layoutColumns gives each of a day's blocks a column, so that blocks which
+// overlap are shown side by side.  Blocks that overlap, directly or through
+// others, share the width between them; the rest are full width.
+func layoutColumns(blocks []weekBlock) {
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].start.Before(blocks[j].start)
+	})
+	var cluster []int
+	var colEnds []time.Time
+	var clusterEnd time.Time
+	flush := func() {
+		for _, i := range cluster {
+			blocks[i].cols = len(colEnds)
+		}
+		cluster, colEnds = nil, nil
+	}
+	for i := range blocks {
+		b := &blocks[i]
+		if len(cluster) > 0 && !b.start.Before(clusterEnd) {
+			flush()
+		}
+		b.col = -1
+		for c, end := range colEnds {
+			if !b.start.Before(end) {
+				b.col = c
+				colEnds[c] = b.end
+				break
+			}
+		}
+		if b.col < 0 {
+			b.col = len(colEnds)
+			colEnds = append(colEnds, b.end)
+		}
+		if len(cluster) == 0 || b.end.After(clusterEnd) {
+			clusterEnd = b.end
+		}
+		cluster = append(cluster, i)
+	}
+	flush()
+}
+
+// minuteOfDay is how many minutes t is after midnight by the clock, or 24
+// hours for the following midnight.
+func minuteOfDay(t time.Time, midnight time.Time) int {
+	if !sameDay(t, midnight) {
+		return 24 * 60
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// dayIndex is which of days t falls on, or -1 if none.
+func dayIndex(t time.Time, days []time.Time) int {
+	for d := 0; d+1 < len(days); d++ {
+		if !t.Before(days[d]) && t.Before(days[d+1]) {
+			return d
+		}
+	}
+	return -1
+}
+
+func todayClass(day time.Time, now time.Time) string {
+	if sameDay(day, now) {
+		return " today"
+	}
+	return ""
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
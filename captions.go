@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captionSeparator joins the parts of a caption, as in
+// "Summer 2019 · Lake Michigan".
+const captionSeparator = " · "
+
+// albumFile is the name of an optional file in a photo folder whose text is
+// added to the caption of every photo in it.
+const albumFile = "album.txt"
+
+// place is one entry of the offline gazetteer used to name where a photo
+// was taken.
+type place struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+// gazetteer is loaded from config.GazetteerFile the first time a photo with
+// a location is captioned.
+var gazetteer struct {
+	sync.Once
+	places []place
+}
+
+// photoCaption describes photo from its EXIF date and location and any
+// caption files beside it, e.g. "Summer 2019 · Lake Michigan · Grandma's
+// 80th".  A photo with none of these gets "".
+func photoCaption(config configStruct, photo string) string {
+	file := filepath.Join(config.PhotosDir, filepath.FromSlash(photo))
+	var parts []string
+
+	if meta, err := cachedPhotoMeta(file); err == nil {
+		if !meta.Taken.IsZero() {
+			southern := meta.HasGPS && meta.Latitude < 0
+			if !meta.HasGPS {
+				if lat, err := strconv.ParseFloat(config.Latitude, 64); err == nil {
+					southern = lat < 0
+				}
+			}
+			parts = append(parts, season(meta.Taken, southern)+" "+strconv.Itoa(meta.Taken.Year()))
+		}
+		if meta.HasGPS {
+			if name := nearestPlace(config, meta.Latitude, meta.Longitude); name != "" {
+				parts = append(parts, name)
+			}
+		}
+	}
+
+	if album := readCaptionFile(filepath.Join(filepath.Dir(file), albumFile)); album != "" {
+		parts = append(parts, album)
+	}
+	// A sidecar is named after the photo, with or without its extension
+	sidecar := readCaptionFile(file + ".txt")
+	if sidecar == "" {
+		sidecar = readCaptionFile(strings.TrimSuffix(file, filepath.Ext(file)) + ".txt")
+	}
+	if sidecar != "" {
+		parts = append(parts, sidecar)
+	}
+	return strings.Join(parts, captionSeparator)
+}
+
+// season names the season of t, using the meteorological seasons.
+func season(t time.Time, southern bool) string {
+	seasons := []string{"Winter", "Spring", "Summer", "Autumn"}
+	i := int(t.Month()) % 12 / 3
+	if southern {
+		i = (i + 2) % 4
+	}
+	return seasons[i]
+}
+
+// readCaptionFile returns the text of a caption file on one line, or "" if
+// there isn't one.
+func readCaptionFile(path string) string {
+	captionBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(string(captionBytes)), " ")
+}
+
+// onThisDay reports whether t falls on today's date in an earlier year.
+func onThisDay(t time.Time, now time.Time) bool {
+	return !t.IsZero() && t.Year() < now.Year() && t.Month() == now.Month() && t.Day() == now.Day()
+}
+
+// onThisDayShown remembers which "on this day" photos have been shown
+// today, so each is shown once before the deck carries on.
+var onThisDayShown struct {
+	sync.Mutex
+	day    string
+	photos map[string]bool
+}
+
+// onThisDayPhoto returns a photo taken on today's date in an earlier year
+// that hasn't been shown yet today, or "" if there are none left.
+func onThisDayPhoto(config configStruct, photos []string) string {
+	if !config.PhotoOnThisDay {
+		return ""
+	}
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	onThisDayShown.Lock()
+	defer onThisDayShown.Unlock()
+	if onThisDayShown.day != today {
+		onThisDayShown.day = today
+		onThisDayShown.photos = make(map[string]bool)
+	}
+	for _, photo := range photos {
+		if onThisDayShown.photos[photo] || photoWeight(photo, config) == 0 {
+			continue
+		}
+		meta, err := cachedPhotoMeta(filepath.Join(config.PhotosDir, filepath.FromSlash(photo)))
+		if err != nil || !onThisDay(meta.Taken, now) {
+			continue
+		}
+		onThisDayShown.photos[photo] = true
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: "+photo+" was taken on this day in "+strconv.Itoa(meta.Taken.Year())+"\n")
+		return photo
+	}
+	return ""
+}
+
+// nearestPlace returns the name of the gazetteer place closest to the given
+// coordinates, or "" if none is within config.GazetteerMaxDistance km.
+func nearestPlace(config configStruct, lat float64, lon float64) string {
+	gazetteer.Do(func() {
+		places, err := loadGazetteer(config.GazetteerFile)
+		if err != nil {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Loading gazetteer "+config.GazetteerFile+": "+err.Error()+"\n")
+		}
+		gazetteer.places = places
+	})
+
+	name, best := "", float64(config.GazetteerMaxDistance)
+	for _, p := range gazetteer.places {
+		if d := distanceKm(lat, lon, p.Latitude, p.Longitude); d <= best {
+			name, best = p.Name, d
+		}
+	}
+	return name
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(math.Min(a, 1)))
+}
+
+// loadGazetteer reads a list of places.  Files ending in .txt are taken to
+// be GeoNames dumps, such as cities15000.txt from download.geonames.org,
+// with the name in the second tab-separated column and the coordinates in
+// the fifth and sixth.  Anything else is CSV with a header and columns
+// name, latitude, longitude.
+func loadGazetteer(path string) ([]place, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var places []place
+	add := func(name string, lat string, lon string) {
+		la, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+		lo, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+		if err1 == nil && err2 == nil && strings.TrimSpace(name) != "" {
+			places = append(places, place{Name: strings.TrimSpace(name), Latitude: la, Longitude: lo})
+		}
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".txt") {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), "\t")
+			if len(fields) > 5 {
+				add(fields[1], fields[4], fields[5])
+			}
+		}
+		return places, scanner.Err()
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return places, err
+		}
+		if first || len(record) < 3 {
+			continue
+		}
+		add(record[0], record[1], record[2])
+	}
+	return places, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// photoMeta is what the planner needs to know about a photo before showing
+// it.  Width and Height are as displayed, after applying Orientation.
+type photoMeta struct {
+	Width       int
+	Height      int
+	Orientation int       // EXIF orientation, 1 to 8; 1 is upright
+	Taken       time.Time // EXIF DateTimeOriginal, zero if unknown
+	HasGPS      bool
+	Latitude    float64
+	Longitude   float64
+}
+
+func (m photoMeta) portrait() bool {
+	return m.Height > m.Width
+}
+
+// EXIF tags read by the planner
+const (
+	exifOrientation      = 0x0112
+	exifIFDPointer       = 0x8769
+	exifGPSPointer       = 0x8825
+	exifDateTimeOriginal = 0x9003
+	exifGPSLatitudeRef   = 0x0001
+	exifGPSLatitude      = 0x0002
+	exifGPSLongitudeRef  = 0x0003
+	exifGPSLongitude     = 0x0004
+)
+
+// exifEntry is one raw tag from an EXIF image file directory.
+type exifEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// exifData holds the tags of a photo's EXIF block, keyed by tag number.
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  map[uint16]exifEntry
+	exif  map[uint16]exifEntry
+	gps   map[uint16]exifEntry
+}
+
+// readPhotoMeta returns the displayed size and EXIF orientation of the
+// photo at path.
+func readPhotoMeta(path string) (photoMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return photoMeta{}, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return photoMeta{}, err
+	}
+	meta := photoMeta{Width: cfg.Width, Height: cfg.Height, Orientation: 1}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return meta, err
+	}
+	if exif, err := readExif(f); err == nil {
+		if o := exif.uint(exif.ifd0, exifOrientation); o >= 1 && o <= 8 {
+			meta.Orientation = int(o)
+		}
+		if taken := exif.string(exif.exif, exifDateTimeOriginal); taken != "" {
+			// EXIF times have no zone and are taken to be local
+			if t, err := time.ParseInLocation("2006:01:02 15:04:05", taken, time.Local); err == nil {
+				meta.Taken = t
+			}
+		}
+		lat, latOK := exif.degrees(exif.gps, exifGPSLatitude, exifGPSLatitudeRef, "S")
+		lon, lonOK := exif.degrees(exif.gps, exifGPSLongitude, exifGPSLongitudeRef, "W")
+		if latOK && lonOK && !(lat == 0 && lon == 0) {
+			meta.HasGPS, meta.Latitude, meta.Longitude = true, lat, lon
+		}
+	}
+	if meta.Orientation >= 5 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	return meta, nil
+}
+
+// photoMetaCache remembers readPhotoMeta results by path, so scanning every
+// photo for its date or shape only reads the files that have changed.
+var photoMetaCache struct {
+	sync.Mutex
+	entries map[string]cachedMeta
+}
+
+type cachedMeta struct {
+	modTime time.Time
+	size    int64
+	meta    photoMeta
+}
+
+// cachedPhotoMeta is readPhotoMeta for photos that are looked at often.
+func cachedPhotoMeta(path string) (photoMeta, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return photoMeta{}, err
+	}
+	photoMetaCache.Lock()
+	c, ok := photoMetaCache.entries[path]
+	photoMetaCache.Unlock()
+	if ok && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.meta, nil
+	}
+
+	meta, err := readPhotoMeta(path)
+	if err != nil {
+		return meta, err
+	}
+	photoMetaCache.Lock()
+	if photoMetaCache.entries == nil {
+		photoMetaCache.entries = make(map[string]cachedMeta)
+	}
+	photoMetaCache.entries[path] = cachedMeta{modTime: info.ModTime(), size: info.Size(), meta: meta}
+	photoMetaCache.Unlock()
+	return meta, nil
+}
+
+// readExif finds the APP1 Exif segment of a JPEG and parses its first image
+// file directory.
+func readExif(r io.Reader) (*exifData, error) {
+	br := &byteReader{r: r}
+	if br.u8() != 0xFF || br.u8() != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	for br.err == nil {
+		if br.u8() != 0xFF {
+			return nil, errors.New("bad JPEG marker")
+		}
+		marker := br.u8()
+		for marker == 0xFF {
+			marker = br.u8()
+		}
+		if marker == 0xD9 || marker == 0xDA {
+			break
+		}
+		length := int(br.u8())<<8 | int(br.u8())
+		if length < 2 {
+			return nil, errors.New("bad JPEG segment")
+		}
+		segment := br.bytes(length - 2)
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseExif(segment[6:])
+		}
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return nil, errors.New("no EXIF data")
+}
+
+func parseExif(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("short EXIF data")
+	}
+	exif := &exifData{}
+	switch string(tiff[:2]) {
+	case "II":
+		exif.order = binary.LittleEndian
+	case "MM":
+		exif.order = binary.BigEndian
+	default:
+		return nil, errors.New("bad EXIF byte order")
+	}
+	exif.ifd0 = exif.readIFD(tiff, exif.order.Uint32(tiff[4:8]))
+	exif.exif = exif.readIFD(tiff, exif.uint(exif.ifd0, exifIFDPointer))
+	exif.gps = exif.readIFD(tiff, exif.uint(exif.ifd0, exifGPSPointer))
+	return exif, nil
+}
+
+// readIFD returns the entries of the image file directory at offset.
+// Values of four bytes or less are stored inline; longer ones are fetched
+// from their offset.  Malformed entries are skipped.  Offsets and counts
+// come from the file, so they are checked as uint64, where they cannot
+// overflow, before they are used.
+func (e *exifData) readIFD(tiff []byte, offset uint32) map[uint16]exifEntry {
+	entries := make(map[uint16]exifEntry)
+	end := uint64(len(tiff))
+	if offset == 0 || uint64(offset)+2 > end {
+		return entries
+	}
+	count := int(e.order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		at := uint64(offset) + 2 + uint64(i)*12
+		if at+12 > end {
+			break
+		}
+		tag := e.order.Uint16(tiff[at:])
+		entry := exifEntry{Type: e.order.Uint16(tiff[at+2:]), Count: e.order.Uint32(tiff[at+4:])}
+		typeSize := uint64(exifTypeSize(entry.Type))
+		if typeSize == 0 || entry.Count == 0 || uint64(entry.Count) > end/typeSize {
+			continue
+		}
+		size := typeSize * uint64(entry.Count)
+		if size <= 4 {
+			entry.Value = tiff[at+8 : at+8+size]
+		} else {
+			valueAt := uint64(e.order.Uint32(tiff[at+8:]))
+			if valueAt+size > end {
+				continue
+			}
+			entry.Value = tiff[valueAt : valueAt+size]
+		}
+		entries[tag] = entry
+	}
+	return entries
+}
+
+// uint returns a SHORT or LONG tag as a number, or 0 if it is missing.
+func (e *exifData) uint(ifd map[uint16]exifEntry, tag uint16) uint32 {
+	entry, ok := ifd[tag]
+	if !ok {
+		return 0
+	}
+	switch entry.Type {
+	case 3:
+		return uint32(e.order.Uint16(entry.Value))
+	case 4:
+		return e.order.Uint32(entry.Value)
+	}
+	return 0
+}
+
+// string returns an ASCII tag without its trailing NULs.
+func (e *exifData) string(ifd map[uint16]exifEntry, tag uint16) string {
+	entry, ok := ifd[tag]
+	if !ok || entry.Type != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(entry.Value), "\x00 ")
+}
+
+// degrees returns a GPS latitude or longitude, stored as three RATIONALs
+// of degrees, minutes and seconds, negated when its reference tag is neg.
+func (e *exifData) degrees(ifd map[uint16]exifEntry, tag uint16, refTag uint16, neg string) (float64, bool) {
+	entry, ok := ifd[tag]
+	if !ok || entry.Type != 5 || entry.Count != 3 {
+		return 0, false
+	}
+	var dms [3]float64
+	for i := range dms {
+		num := e.order.Uint32(entry.Value[i*8:])
+		den := e.order.Uint32(entry.Value[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		dms[i] = float64(num) / float64(den)
+	}
+	deg := dms[0] + dms[1]/60 + dms[2]/3600
+	if e.string(ifd, refTag) == neg {
+		deg = -deg
+	}
+	return deg, true
+}
+
+func exifTypeSize(t uint16) int {
+	switch t {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return 0
+}
+
+// orientImage rotates and flips img so that it is upright, undoing the EXIF
+// orientation it was stored with.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	ow, oh := w, h
+	if orientation >= 5 {
+		ow, oh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, ow, oh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored and rotated 90 counter-clockwise
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored and rotated 90 clockwise
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// byteReader reads a JPEG header, remembering the first error.
+type byteReader struct {
+	r   io.Reader
+	err error
+	buf [1]byte
+}
+
+func (b *byteReader) u8() byte {
+	if b.err != nil {
+		return 0
+	}
+	_, b.err = io.ReadFull(b.r, b.buf[:])
+	return b.buf[0]
+}
+
+func (b *byteReader) bytes(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(b.r, int64(n)))
+	if err == nil && len(data) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	b.err = err
+	return data
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestParseExif feeds parseExif little-endian TIFF blocks with directories
+// and values that point past the end of the data, or whose sizes overflow,
+// and checks the good entries are still read and the bad ones are skipped.
+func TestParseExif(t *testing.T) {
+	type ifdEntry struct {
+		tag, typ     uint16
+		count, value uint32
+	}
+	tiff := func(ifd0 uint32, dirCount uint16, entries ...ifdEntry) []byte {
+		le := binary.LittleEndian
+		b := make([]byte, 10+12*len(entries))
+		copy(b, "II*\x00")
+		le.PutUint32(b[4:], ifd0)
+		le.PutUint16(b[8:], dirCount)
+		for i, e := range entries {
+			at := b[10+12*i:]
+			le.PutUint16(at, e.tag)
+			le.PutUint16(at[2:], e.typ)
+			le.PutUint32(at[4:], e.count)
+			le.PutUint32(at[8:], e.value)
+		}
+		return b
+	}
+	upright := ifdEntry{exifOrientation, 3, 1, 6}
+	tests := []struct {
+		name string
+		tiff []byte
+		want uint32 // orientation, or 0 if it should not be read
+	}{
+		{"valid", tiff(8, 1, upright), 6},
+		{"directory past the end", tiff(0xFFFFFFFE, 1, upright), 0},
+		{"directory longer than the data", tiff(8, 40, upright), 6},
+		{"count too large for the data", tiff(8, 1, ifdEntry{exifOrientation, 3, 0xFFFFFFFF, 6}), 0},
+		{"count whose size overflows", tiff(8, 2, ifdEntry{exifDateTimeOriginal, 5, 0x20000001, 0}, upright), 6},
+		{"value past the end", tiff(8, 2, ifdEntry{exifDateTimeOriginal, 2, 20, 0xFFFFFFF0}, upright), 6},
+		{"sub-directory past the end", tiff(8, 2, ifdEntry{exifIFDPointer, 4, 1, 0xFFFFFFF0}, upright), 6},
+	}
+	for _, test := range tests {
+		exif, err := parseExif(test.tiff)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := exif.uint(exif.ifd0, exifOrientation); got != test.want {
+			t.Errorf("%s: orientation = %d, want %d", test.name, got, test.want)
+		}
+		if taken := exif.string(exif.exif, exifDateTimeOriginal); taken != "" || len(exif.exif) != 0 {
+			t.Errorf("%s: read %d EXIF sub-directory entries", test.name, len(exif.exif))
+		}
+		if _, ok := exif.ifd0[exifDateTimeOriginal]; ok {
+			t.Errorf("%s: malformed entry was read", test.name)
+		}
+	}
+}
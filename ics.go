@@ -0,0 +1,891 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icsMaxPeriods bounds how many days, weeks, months or years of a
+// recurrence rule are stepped through, so a rule that never matches can't
+// loop forever.
+const icsMaxPeriods = 100000
+
+// icsProperty is one content line of an iCalendar file: NAME;PARAM=x:VALUE.
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsComponent is a BEGIN/END block, such as VEVENT or VTIMEZONE, with its
+// properties and nested components.
+type icsComponent struct {
+	Name       string
+	Properties []icsProperty
+	Components []*icsComponent
+}
+
+func (c *icsComponent) prop(name string) (icsProperty, bool) {
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return icsProperty{}, false
+}
+
+func (c *icsComponent) value(name string) string {
+	p, _ := c.prop(name)
+	return p.Value
+}
+
+func (c *icsComponent) props(name string) []icsProperty {
+	var found []icsProperty
+	for _, p := range c.Properties {
+		if p.Name == name {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// parseICS reads an iCalendar (RFC 5545) stream into its top-level
+// components, normally a single VCALENDAR.
+func parseICS(r io.Reader) ([]*icsComponent, error) {
+	var top []*icsComponent
+	var stack []*icsComponent
+
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		p, err := parseICSLine(line)
+		if err != nil {
+			continue
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := &icsComponent{Name: strings.ToUpper(p.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			} else {
+				top = append(top, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.Properties = append(c.Properties, p)
+			}
+		}
+	}
+	if len(top) == 0 {
+		return nil, errors.New("no iCalendar data")
+	}
+	return top, nil
+}
+
+// unfoldICS joins lines folded onto the next line with a leading space or
+// tab.
+func unfoldICS(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseICSLine splits a content line into its name, parameters and value.
+// Parameter values may be quoted, and quoted values may contain ':' and ';'.
+func parseICSLine(line string) (icsProperty, error) {
+	p := icsProperty{Params: make(map[string]string)}
+	inQuote := false
+	start := 0
+	var parts []string
+	for i, ch := range line {
+		switch {
+		case ch == '"':
+			inQuote = !inQuote
+		case ch == ';' && !inQuote:
+			parts = append(parts, line[start:i])
+			start = i + 1
+		case ch == ':' && !inQuote:
+			parts = append(parts, line[start:i])
+			p.Value = line[i+1:]
+			p.Name = strings.ToUpper(parts[0])
+			for _, param := range parts[1:] {
+				if eq := strings.Index(param, "="); eq > 0 {
+					p.Params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], "\"")
+				}
+			}
+			return p, nil
+		}
+	}
+	return p, errors.New("no value in iCalendar line")
+}
+
+// icsText undoes the escaping of TEXT values.
+func icsText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// icsZones resolves the TZID parameters of a calendar.  Standard zone names
+// are looked up in the system's zone database; anything else, such as the
+// Windows zone names Outlook uses, is worked out from the calendar's own
+// VTIMEZONE definitions.
+type icsZones struct {
+	defs map[string]*icsComponent
+}
+
+func newICSZones(cal *icsComponent) icsZones {
+	zones := icsZones{defs: make(map[string]*icsComponent)}
+	for _, c := range cal.Components {
+		if c.Name == "VTIMEZONE" {
+			zones.defs[c.value("TZID")] = c
+		}
+	}
+	return zones
+}
+
+// icsTime is a DATE or DATE-TIME value.  Wall is the time as written, in
+// UTC for convenience; UTC is true if it really is UTC, and TZID names its
+// zone otherwise.  A DATE-TIME with neither is floating, in local time.
+type icsTime struct {
+	Wall   time.Time
+	AllDay bool
+	UTC    bool
+	TZID   string
+}
+
+func parseICSTime(value string, params map[string]string) (icsTime, error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return icsTime{Wall: t, AllDay: true}, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return icsTime{Wall: t, UTC: true}, err
+	}
+	t, err := time.Parse("20060102T150405", value)
+	return icsTime{Wall: t, TZID: params["TZID"]}, err
+}
+
+// withWall returns t with a different wall-clock time, in the same zone.
+func (t icsTime) withWall(wall time.Time) icsTime {
+	t.Wall = wall
+	return t
+}
+
+// resolve returns the instant t stands for.
+func (z icsZones) resolve(t icsTime) time.Time {
+	w := t.Wall
+	switch {
+	case t.UTC:
+		return w
+	case t.AllDay || t.TZID == "":
+		return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, time.Local)
+	}
+	if loc, err := time.LoadLocation(strings.TrimPrefix(t.TZID, "/")); err == nil {
+		return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc)
+	}
+	if def, ok := z.defs[t.TZID]; ok {
+		return w.Add(-z.offset(def, w))
+	}
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, time.Local)
+}
+
+// offset is a VTIMEZONE's UTC offset at a wall-clock time: that of the
+// STANDARD or DAYLIGHT observance whose latest onset comes before it.
+func (z icsZones) offset(def *icsComponent, wall time.Time) time.Duration {
+	var best time.Time
+	var offset time.Duration
+	found := false
+	for _, obs := range def.Components {
+		if obs.Name != "STANDARD" && obs.Name != "DAYLIGHT" {
+			continue
+		}
+		startProp, ok := obs.prop("DTSTART")
+		if !ok {
+			continue
+		}
+		start, err := parseICSTime(startProp.Value, startProp.Params)
+		if err != nil {
+			continue
+		}
+		onsets := []time.Time{start.Wall}
+		if rule, ok := obs.prop("RRULE"); ok {
+			if r, err := parseRRule(rule.Value); err == nil {
+				// Only the onset most recently before wall matters
+				onsets = r.expand(start.Wall, wall.AddDate(-2, 0, 0), wall, 0)
+			}
+		}
+		for _, rd := range obs.props("RDATE") {
+			for _, v := range strings.Split(rd.Value, ",") {
+				if t, err := parseICSTime(v, rd.Params); err == nil {
+					onsets = append(onsets, t.Wall)
+				}
+			}
+		}
+		for _, onset := range onsets {
+			if !onset.After(wall) && (!found || onset.After(best)) {
+				best, found = onset, true
+				offset = parseUTCOffset(obs.value("TZOFFSETTO"))
+			}
+		}
+	}
+	return offset
+}
+
+// parseUTCOffset parses offsets such as -0500 or +053000.
+func parseUTCOffset(value string) time.Duration {
+	if len(value) < 5 {
+		return 0
+	}
+	sign := time.Duration(1)
+	if value[0] == '-' {
+		sign = -1
+	}
+	h, _ := strconv.Atoi(value[1:3])
+	m, _ := strconv.Atoi(value[3:5])
+	s := 0
+	if len(value) >= 7 {
+		s, _ = strconv.Atoi(value[5:7])
+	}
+	return sign * (time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second)
+}
+
+// parseICSDuration parses DURATION values such as PT1H30M, P1D or -P15M.
+func parseICSDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	v := value
+	if strings.HasPrefix(v, "-") {
+		sign, v = -1, v[1:]
+	}
+	v = strings.TrimPrefix(v, "+")
+	if !strings.HasPrefix(v, "P") {
+		return 0, errors.New("bad duration " + value)
+	}
+	var d time.Duration
+	n := 0
+	digits := false
+	inTime := false
+	for _, ch := range v[1:] {
+		switch {
+		case ch >= '0' && ch <= '9':
+			n = n*10 + int(ch-'0')
+			digits = true
+			continue
+		case ch == 'T':
+			inTime = true
+			continue
+		}
+		if !digits {
+			return 0, errors.New("bad duration " + value)
+		}
+		switch {
+		case ch == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case ch == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case ch == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case ch == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case ch == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, errors.New("bad duration " + value)
+		}
+		n, digits = 0, false
+	}
+	return sign * d, nil
+}
+
+// icsWeekday is a BYDAY entry: a weekday and, for monthly and yearly
+// rules, which one of the month or year it is (1 first, -1 last, 0 every).
+type icsWeekday struct {
+	N   int
+	Day time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// rrule is a parsed RRULE.  BYWEEKNO, BYYEARDAY and rules more frequent
+// than daily aren't supported; such events are shown once, on DTSTART.
+type rrule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *icsTime
+	ByDay      []icsWeekday
+	ByMonthDay []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+func parseRRule(value string) (rrule, error) {
+	r := rrule{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			continue
+		}
+		key, val := strings.ToUpper(part[:eq]), part[eq+1:]
+		switch key {
+		case "FREQ":
+			r.Freq = strings.ToUpper(val)
+		case "INTERVAL":
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				r.Interval = n
+			}
+		case "COUNT":
+			r.Count, _ = strconv.Atoi(val)
+		case "UNTIL":
+			if t, err := parseICSTime(val, nil); err == nil {
+				r.Until = &t
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				d = strings.ToUpper(strings.TrimSpace(d))
+				if len(d) < 2 {
+					continue
+				}
+				day, ok := icsWeekdays[d[len(d)-2:]]
+				if !ok {
+					continue
+				}
+				n, _ := strconv.Atoi(d[:len(d)-2])
+				r.ByDay = append(r.ByDay, icsWeekday{N: n, Day: day})
+			}
+		case "BYMONTHDAY":
+			r.ByMonthDay = icsInts(val)
+		case "BYMONTH":
+			r.ByMonth = icsInts(val)
+		case "BYSETPOS":
+			r.BySetPos = icsInts(val)
+		case "WKST":
+			if day, ok := icsWeekdays[strings.ToUpper(val)]; ok {
+				r.WeekStart = day
+			}
+		case "BYWEEKNO", "BYYEARDAY", "BYHOUR", "BYMINUTE", "BYSECOND":
+			return r, errors.New("unsupported RRULE part " + key)
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+		return r, nil
+	}
+	return r, errors.New("unsupported RRULE frequency " + r.Freq)
+}
+
+func icsInts(value string) []int {
+	var ints []int
+	for _, v := range strings.Split(value, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			ints = append(ints, n)
+		}
+	}
+	return ints
+}
+
+// expand returns the wall-clock start times of the rule's occurrences,
+// beginning with dtstart, up to and including end.  until, if the rule has
+// one, is compared in the same wall clock; limit, if not 0, caps how many
+// are returned.  Unless the rule has a COUNT, which can only be kept by
+// counting from dtstart, the periods ending before after are skipped, so
+// a long-running rule isn't followed from its start every time.
+func (r rrule) expand(dtstart time.Time, after time.Time, end time.Time, limit int) []time.Time {
+	var out []time.Time
+	count := 0
+	first := 0
+	if r.Count == 0 && after.After(dtstart) {
+		first = r.periodOf(dtstart, after) - 1
+		if first < 0 {
+			first = 0
+		}
+	}
+	for period := first; period < icsMaxPeriods; period++ {
+		if r.periodStart(dtstart, period).After(end) {
+			return out
+		}
+		for _, t := range r.candidates(dtstart, period) {
+			if t.Before(dtstart) {
+				continue
+			}
+			if r.Until != nil && t.After(r.Until.Wall) {
+				return out
+			}
+			if t.After(end) {
+				return out
+			}
+			count++
+			if r.Count > 0 && count > r.Count {
+				return out
+			}
+			out = append(out, t)
+			if limit > 0 && len(out) >= limit {
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// periodOf is the number of the rule's period that t falls in.
+func (r rrule) periodOf(dtstart time.Time, t time.Time) int {
+	y, m, d := dtstart.Date()
+	ty, tm, td := t.Date()
+	days := int(time.Date(ty, tm, td, 0, 0, 0, 0, time.UTC).Sub(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	switch r.Freq {
+	case "DAILY":
+		return days / r.Interval
+	case "WEEKLY":
+		back := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+		return (days + back) / (7 * r.Interval)
+	case "MONTHLY":
+		return ((ty-y)*12 + int(tm) - int(m)) / r.Interval
+	}
+	return (ty - y) / r.Interval
+}
+
+// periodStart is the first day of the rule's period-th period.
+func (r rrule) periodStart(dtstart time.Time, period int) time.Time {
+	y, m, d := dtstart.Date()
+	n := period * r.Interval
+	switch r.Freq {
+	case "DAILY":
+		return time.Date(y, m, d+n, 0, 0, 0, 0, time.UTC)
+	case "WEEKLY":
+		back := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+		return time.Date(y, m, d-back+7*n, 0, 0, 0, 0, time.UTC)
+	case "MONTHLY":
+		return time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y+n, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// candidates lists the occurrences in the rule's period-th period, in
+// order, before COUNT and UNTIL are applied.
+func (r rrule) candidates(dtstart time.Time, period int) []time.Time {
+	start := r.periodStart(dtstart, period)
+	hh, mm, ss := dtstart.Clock()
+	var days []time.Time
+
+	switch r.Freq {
+	case "DAILY":
+		days = []time.Time{start}
+	case "WEEKLY":
+		for i := 0; i < 7; i++ {
+			day := start.AddDate(0, 0, i)
+			if len(r.ByDay) == 0 && day.Weekday() != dtstart.Weekday() {
+				continue
+			}
+			days = append(days, day)
+		}
+	case "MONTHLY":
+		days = r.monthDays(start, dtstart)
+	case "YEARLY":
+		months := r.ByMonth
+		switch {
+		case len(months) > 0:
+		case len(r.ByMonthDay) > 0:
+			// BYMONTHDAY picks days from every month of the year
+			months = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+		case len(r.ByDay) == 0:
+			months = []int{int(dtstart.Month())}
+		}
+		if len(months) == 0 {
+			// BYDAY across the whole year, e.g. the 20th Monday
+			days = r.weekdaysIn(start, start.AddDate(1, 0, 0))
+		}
+		for _, m := range months {
+			days = append(days, r.monthDays(time.Date(start.Year(), time.Month(m), 1, 0, 0, 0, 0, time.UTC), dtstart)...)
+		}
+	}
+
+	var kept []time.Time
+	for _, day := range days {
+		if len(r.ByMonth) > 0 && !containsInt(r.ByMonth, int(day.Month())) {
+			continue
+		}
+		if len(r.ByMonthDay) > 0 && (r.Freq == "DAILY" || r.Freq == "WEEKLY") && !matchesMonthDay(r.ByMonthDay, day) {
+			continue
+		}
+		if len(r.ByDay) > 0 && (r.Freq == "DAILY" || r.Freq == "WEEKLY") && !matchesWeekday(r.ByDay, day) {
+			continue
+		}
+		kept = append(kept, time.Date(day.Year(), day.Month(), day.Day(), hh, mm, ss, 0, time.UTC))
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Before(kept[j]) })
+
+	if len(r.BySetPos) > 0 {
+		var picked []time.Time
+		for _, pos := range r.BySetPos {
+			switch {
+			case pos > 0 && pos <= len(kept):
+				picked = append(picked, kept[pos-1])
+			case pos < 0 && -pos <= len(kept):
+				picked = append(picked, kept[len(kept)+pos])
+			}
+		}
+		sort.Slice(picked, func(i, j int) bool { return picked[i].Before(picked[j]) })
+		kept = picked
+	}
+	return kept
+}
+
+// monthDays lists the days of the month starting at first that match the
+// rule's BYMONTHDAY and BYDAY, or DTSTART's day of the month without them.
+func (r rrule) monthDays(first time.Time, dtstart time.Time) []time.Time {
+	next := first.AddDate(0, 1, 0)
+	length := next.AddDate(0, 0, -1).Day()
+
+	var byMonthDay []time.Time
+	for _, md := range r.ByMonthDay {
+		switch {
+		case md > 0 && md <= length:
+			byMonthDay = append(byMonthDay, first.AddDate(0, 0, md-1))
+		case md < 0 && -md <= length:
+			byMonthDay = append(byMonthDay, first.AddDate(0, 0, length+md))
+		}
+	}
+	switch {
+	case len(r.ByMonthDay) > 0 && len(r.ByDay) > 0:
+		var both []time.Time
+		for _, day := range byMonthDay {
+			if matchesWeekday(r.ByDay, day) {
+				both = append(both, day)
+			}
+		}
+		return both
+	case len(r.ByMonthDay) > 0:
+		return byMonthDay
+	case len(r.ByDay) > 0:
+		return r.weekdaysIn(first, next)
+	}
+	if dtstart.Day() > length {
+		// e.g. the 31st in a 30 day month, which RFC 5545 skips
+		return nil
+	}
+	return []time.Time{first.AddDate(0, 0, dtstart.Day()-1)}
+}
+
+// weekdaysIn lists the days from first up to next that match BYDAY, with
+// ordinals such as 2MO or -1FR counted within that span.
+func (r rrule) weekdaysIn(first time.Time, next time.Time) []time.Time {
+	var days []time.Time
+	for _, wd := range r.ByDay {
+		var matches []time.Time
+		for day := first; day.Before(next); day = day.AddDate(0, 0, 1) {
+			if day.Weekday() == wd.Day {
+				matches = append(matches, day)
+			}
+		}
+		switch {
+		case wd.N == 0:
+			days = append(days, matches...)
+		case wd.N > 0 && wd.N <= len(matches):
+			days = append(days, matches[wd.N-1])
+		case wd.N < 0 && -wd.N <= len(matches):
+			days = append(days, matches[len(matches)+wd.N])
+		}
+	}
+	return days
+}
+
+func matchesWeekday(byDay []icsWeekday, day time.Time) bool {
+	for _, wd := range byDay {
+		if wd.Day == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesMonthDay(byMonthDay []int, day time.Time) bool {
+	length := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, md := range byMonthDay {
+		if md == day.Day() || (md < 0 && length+md+1 == day.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+// icsEvents returns the events of an iCalendar stream that overlap from to
+// to, with recurring events expanded into one event per occurrence.
+// EXDATE and RDATE are applied, and occurrences changed or cancelled on
+// their own (a VEVENT with a RECURRENCE-ID) replace the ones they override.
+func icsEvents(r io.Reader, cal calendarConfig, from time.Time, to time.Time) ([]calendarEvent, error) {
+	components, err := parseICS(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []calendarEvent
+	for _, vcal := range components {
+		zones := newICSZones(vcal)
+
+		// Overrides are keyed by UID and the instant of the occurrence.
+		// earliest keeps the first occurrence each UID overrides, as one
+		// from long ago may have been moved into view.
+		overrides := make(map[string]*icsComponent)
+		earliest := make(map[string]time.Time)
+		for _, c := range vcal.Components {
+			if c.Name != "VEVENT" {
+				continue
+			}
+			if rid, ok := c.prop("RECURRENCE-ID"); ok {
+				if t, err := parseICSTime(rid.Value, rid.Params); err == nil {
+					at := zones.resolve(t)
+					overrides[c.value("UID")+" "+at.UTC().Format(time.RFC3339)] = c
+					if e, ok := earliest[c.value("UID")]; !ok || at.Before(e) {
+						earliest[c.value("UID")] = at
+					}
+				}
+			}
+		}
+
+		for _, c := range vcal.Components {
+			if c.Name != "VEVENT" {
+				continue
+			}
+			if _, ok := c.prop("RECURRENCE-ID"); ok {
+				// Overrides are shown through the event they change, unless
+				// that has no rule to put them in
+				if _, err := masterOf(vcal, c); err == nil {
+					continue
+				}
+			}
+			after := from
+			if e, ok := earliest[c.value("UID")]; ok && e.Before(after) {
+				after = e
+			}
+			occurrences, err := icsOccurrences(c, zones, after, to)
+			if err != nil {
+				logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Skipping event "+c.value("UID")+" in "+cal.Name+": "+err.Error()+"\n")
+				continue
+			}
+			for _, start := range occurrences {
+				event := c
+				if o, ok := overrides[c.value("UID")+" "+zones.resolve(start).UTC().Format(time.RFC3339)]; ok && o != c {
+					event = o
+				}
+				e, err := icsEvent(event, start, zones, cal)
+				if err != nil || strings.EqualFold(event.value("STATUS"), "CANCELLED") {
+					continue
+				}
+				if overlaps(e, from, to) {
+					events = append(events, e)
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// icsWall is t in UTC as a wall clock, as rules are expanded in.
+func icsWall(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// masterOf finds the recurring event an override belongs to.
+func masterOf(vcal *icsComponent, override *icsComponent) (*icsComponent, error) {
+	uid := override.value("UID")
+	for _, c := range vcal.Components {
+		if c.Name == "VEVENT" && c != override && c.value("UID") == uid {
+			if _, ok := c.prop("RECURRENCE-ID"); !ok {
+				return c, nil
+			}
+		}
+	}
+	return nil, errors.New("no recurring event for " + uid)
+}
+
+// icsOccurrences returns the start of each occurrence of a VEVENT up to to.
+// Those of a rule that ended well before after may be left out.
+func icsOccurrences(c *icsComponent, zones icsZones, after time.Time, to time.Time) ([]icsTime, error) {
+	startProp, ok := c.prop("DTSTART")
+	if !ok {
+		return nil, errors.New("no DTSTART")
+	}
+	dtstart, err := parseICSTime(startProp.Value, startProp.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	starts := []icsTime{dtstart}
+	if ruleProp, ok := c.prop("RRULE"); ok {
+		rule, err := parseRRule(ruleProp.Value)
+		if err != nil {
+			logger("calendar", time.Now().Format(time.RFC850)+"  INFO: "+err.Error()+" in "+c.value("UID")+", showing it once\n")
+		} else {
+			if rule.Until != nil && rule.Until.UTC && !dtstart.UTC {
+				// UNTIL is in UTC while the rule runs in wall-clock time
+				until := dtstart.withWall(rule.Until.Wall)
+				shift := zones.resolve(until).Sub(rule.Until.Wall)
+				rule.Until.Wall = rule.Until.Wall.Add(-shift)
+			}
+			// The rule runs in the event's wall clock, which is at most a
+			// day either side of UTC
+			end := icsWall(to.Add(48 * time.Hour))
+			skip := icsWall(after.Add(-48*time.Hour - icsLength(c, dtstart, zones)))
+			starts = nil
+			for _, t := range rule.expand(dtstart.Wall, skip, end, 0) {
+				starts = append(starts, dtstart.withWall(t))
+			}
+		}
+	}
+	for _, rd := range c.props("RDATE") {
+		for _, v := range strings.Split(rd.Value, ",") {
+			if t, err := parseICSTime(v, mergeParams(startProp.Params, rd.Params)); err == nil {
+				starts = append(starts, t)
+			}
+		}
+	}
+
+	excluded := make(map[string]bool)
+	for _, ex := range c.props("EXDATE") {
+		for _, v := range strings.Split(ex.Value, ",") {
+			if t, err := parseICSTime(v, mergeParams(startProp.Params, ex.Params)); err == nil {
+				excluded[icsKey(t, zones)] = true
+			}
+		}
+	}
+	var kept []icsTime
+	for _, t := range starts {
+		if !excluded[icsKey(t, zones)] {
+			kept = append(kept, t)
+		}
+	}
+	return kept, nil
+}
+
+// mergeParams gives an EXDATE or RDATE the TZID of DTSTART unless it has
+// its own.
+func mergeParams(base map[string]string, own map[string]string) map[string]string {
+	merged := map[string]string{}
+	if tz, ok := base["TZID"]; ok {
+		merged["TZID"] = tz
+	}
+	for k, v := range own {
+		merged[k] = v
+	}
+	return merged
+}
+
+// icsKey identifies an occurrence: by date for all-day events, otherwise
+// by instant.
+func icsKey(t icsTime, zones icsZones) string {
+	if t.AllDay {
+		return t.Wall.Format("20060102")
+	}
+	return zones.resolve(t).UTC().Format(time.RFC3339)
+}
+
+// icsLength is how long an occurrence of c starting at start lasts, from
+// DTEND or DURATION on the event as written.
+func icsLength(c *icsComponent, start icsTime, zones icsZones) time.Duration {
+	length := time.Duration(0)
+	if start.AllDay {
+		length = 24 * time.Hour
+	}
+	if endProp, ok := c.prop("DTEND"); ok {
+		startProp, _ := c.prop("DTSTART")
+		s, err1 := parseICSTime(startProp.Value, startProp.Params)
+		end, err2 := parseICSTime(endProp.Value, endProp.Params)
+		if err1 == nil && err2 == nil {
+			if start.AllDay {
+				length = end.Wall.Sub(s.Wall)
+			} else {
+				length = zones.resolve(end).Sub(zones.resolve(s))
+			}
+		}
+	} else if d := c.value("DURATION"); d != "" {
+		if dur, err := parseICSDuration(d); err == nil {
+			length = dur
+		}
+	}
+	return length
+}
+
+// icsEvent makes the occurrence of c starting at start into a
+// calendarEvent.
+func icsEvent(c *icsComponent, start icsTime, zones icsZones, cal calendarConfig) (calendarEvent, error) {
+	// An override may move its occurrence
+	if startProp, ok := c.prop("DTSTART"); ok {
+		if _, isOverride := c.prop("RECURRENCE-ID"); isOverride {
+			if t, err := parseICSTime(startProp.Value, startProp.Params); err == nil {
+				start = t
+			}
+		}
+	}
+
+	e := calendarEvent{
+		ID:       c.value("UID") + "/" + icsKey(start, zones),
+		Summary:  icsText(c.value("SUMMARY")),
+		Location: icsText(c.value("LOCATION")),
+		Calendar: cal,
+		Start:    zones.resolve(start).Local(),
+		AllDay:   start.AllDay,
+	}
+
+	length := icsLength(c, start, zones)
+	if start.AllDay {
+		// Whole days, so the end stays at midnight across clock changes
+		e.End = time.Date(e.Start.Year(), e.Start.Month(), e.Start.Day()+int(length/(24*time.Hour)), 0, 0, 0, 0, time.Local)
+	} else {
+		e.End = e.Start.Add(length)
+	}
+
+	// Alarms set relative to the start become reminders
+	for _, alarm := range c.Components {
+		if alarm.Name != "VALARM" || strings.EqualFold(alarm.value("ACTION"), "EMAIL") {
+			continue
+		}
+		trigger, ok := alarm.prop("TRIGGER")
+		if !ok || trigger.Params["VALUE"] == "DATE-TIME" || trigger.Params["RELATED"] == "END" {
+			continue
+		}
+		if d, err := parseICSDuration(trigger.Value); err == nil && d <= 0 {
+			e.Reminders = append(e.Reminders, -d)
+		}
+	}
+	return e, nil
+}
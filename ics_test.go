@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestICSEvents reads calendars exported from Google, iCloud, Nextcloud
+// and Outlook, and checks the occurrences of each event in a window.
+// Timed events are listed in UTC, so the zones and clock changes are
+// checked too; all-day events are listed by date.
+func TestICSEvents(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		file     string
+		uid      string
+		from, to time.Time
+		want     []string
+	}{
+		{
+			name: "weekly COUNT with EXDATE across the end of DST",
+			file: "google.ics", uid: "1s8v3k2j9q0f7t4p6m5n3b2c1d@google.com",
+			from: day(2026, 10, 1), to: day(2026, 12, 1),
+			want: []string{"2026-10-13 21:00Z Swim lessons", "2026-10-27 21:00Z Swim lessons", "2026-11-03 22:00Z Swim lessons"},
+		},
+		{
+			name: "UTC UNTIL with TZID start, moved occurrences",
+			file: "google.ics", uid: "7h2k4m6n8p0q1r3s5t7v9w@google.com",
+			from: day(2026, 10, 15), to: day(2026, 12, 1),
+			want: []string{"2026-10-15 20:00Z Piano", "2026-10-20 13:00Z Piano (make-up)", "2026-10-23 21:00Z Piano (moved)", "2026-10-29 20:00Z Piano"},
+		},
+		{
+			name: "all-day event",
+			file: "google.ics", uid: "0a9b8c7d6e5f4g3h2i1j@google.com",
+			from: day(2026, 10, 1), to: day(2026, 12, 1),
+			want: []string{"2026-10-31 all day Halloween"},
+		},
+		{
+			name: "BYSETPOS last weekday of the month",
+			file: "icloud.ics", uid: "5F1C2B3A-9D8E-4F7A-B6C5-D4E3F2A1B0C9",
+			from: day(2026, 9, 1), to: day(2027, 1, 1),
+			want: []string{"2026-09-30 18:00Z Pay the window cleaner", "2026-10-30 19:00Z Pay the window cleaner",
+				"2026-11-30 19:00Z Pay the window cleaner", "2026-12-31 19:00Z Pay the window cleaner"},
+		},
+		{
+			name: "yearly all-day event from long ago",
+			file: "icloud.ics", uid: "A1B2C3D4-E5F6-4789-ABCD-EF0123456789",
+			from: day(2026, 1, 1), to: day(2027, 1, 1),
+			want: []string{"2026-11-21 all day Sam's birthday"},
+		},
+		{
+			name: "UNTIL in the event's own zone",
+			file: "icloud.ics", uid: "0F9E8D7C-6B5A-4938-2716-05F4E3D2C1B0",
+			from: day(2026, 9, 1), to: day(2027, 1, 1),
+			want: []string{"2026-09-03 18:30Z Book club", "2026-10-01 18:30Z Book club", "2026-11-05 19:30Z Book club"},
+		},
+		{
+			name: "daily weekdays since 2020 with EXDATE and a moved occurrence",
+			file: "nextcloud.ics", uid: "2f8d6a1e-3b4c-4d5e-8f90-a1b2c3d4e5f6",
+			from: day(2026, 10, 23), to: day(2026, 10, 29),
+			want: []string{"2026-10-23 07:30Z Standup", "2026-10-26 08:30Z Standup", "2026-10-28 10:00Z Standup (moved)"},
+		},
+		{
+			name: "yearly BYMONTHDAY and BYDAY across every month",
+			file: "nextcloud.ics", uid: "9c0b1a2f-8e7d-4c6b-a5f4-e3d2c1b0a987",
+			from: day(2026, 1, 1), to: day(2028, 1, 1),
+			want: []string{"2026-02-13 19:00Z Friday the 13th film night", "2026-03-13 19:00Z Friday the 13th film night",
+				"2026-11-13 19:00Z Friday the 13th film night", "2027-08-13 18:00Z Friday the 13th film night"},
+		},
+		{
+			name: "yearly BYMONTHDAY without BYMONTH",
+			file: "nextcloud.ics", uid: "4d3c2b1a-0f9e-48d7-b6c5-a4b3c2d1e0f9",
+			from: day(2026, 1, 1), to: day(2026, 6, 15),
+			want: []string{"2026-01-01 all day Pay rent", "2026-02-01 all day Pay rent", "2026-03-01 all day Pay rent",
+				"2026-04-01 all day Pay rent", "2026-05-01 all day Pay rent", "2026-06-01 all day Pay rent"},
+		},
+		{
+			name: "rule that never matches",
+			file: "nextcloud.ics", uid: "6e5d4c3b-2a19-4087-f6e5-d4c3b2a19087",
+			from: day(2026, 3, 1), to: day(2031, 1, 1),
+			want: nil,
+		},
+		{
+			name: "Windows zone name worked out from its VTIMEZONE",
+			file: "outlook.ics", uid: "040000008200E00074C5B7101A82E00800000000B0E1C2D3A4F5DA01000000000000000010000000F1E2D3C4B5A6978899AABBCCDDEEFF00",
+			from: day(2026, 10, 1), to: day(2027, 1, 1),
+			want: []string{"2026-10-22 10:00Z Team lunch", "2026-10-29 11:00Z Team lunch", "2026-11-05 11:00Z Team lunch"},
+		},
+	}
+	for _, test := range tests {
+		events := readTestICS(t, test.file, test.from, test.to)
+		var got []string
+		for _, e := range events {
+			if !strings.HasPrefix(e.ID, test.uid+"/") {
+				continue
+			}
+			if e.AllDay {
+				got = append(got, e.Start.Format("2006-01-02")+" all day "+e.Summary)
+			} else {
+				got = append(got, e.Start.UTC().Format("2006-01-02 15:04Z")+" "+e.Summary)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %s\n got %q\nwant %q", test.name, test.file, got, test.want)
+		}
+	}
+}
+
+func TestICSAlarms(t *testing.T) {
+	events := readTestICS(t, "icloud.ics", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 9, 30, 0, 0, 0, 0, time.UTC))
+	for _, e := range events {
+		if e.Summary == "Book club" {
+			if want := []time.Duration{time.Hour}; !reflect.DeepEqual(e.Reminders, want) {
+				t.Errorf("Book club reminders = %v, want %v", e.Reminders, want)
+			}
+			return
+		}
+	}
+	t.Error("Book club not found")
+}
+
+func TestICSFolding(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "google.ics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	components, err := parseICS(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Bring goggles and a towel. No lesson on the 20th, the pool is closed for cleaning."
+	for _, c := range components[0].Components {
+		if c.value("SUMMARY") == "Swim lessons" {
+			if got := icsText(c.value("DESCRIPTION")); got != want {
+				t.Errorf("DESCRIPTION = %q, want %q", got, want)
+			}
+			return
+		}
+	}
+	t.Error("Swim lessons not found")
+}
+
+func readTestICS(t *testing.T, file string, from time.Time, to time.Time) []calendarEvent {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := icsEvents(f, calendarConfig{Type: "ics", Name: file}, from, to)
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	sortEvents(events)
+	return events
+}
@@ -24,15 +24,343 @@ function getTime() {
         }
         var timeString = hours + ":" + minute;
         document.getElementById("time").innerHTML = timeString;
+        getDate();
     }, 500);
 }
 
+// liveConnected is true while the server's live update channel is open.
+// The page is then updated in place, and only reloaded without it.
+var liveConnected = false;
+
 function refreshFromHTML() {
     var sec = 1000;
     var min = sec * 60;
     var hr = min * 60;
 
     setInterval(function() {
-        location.reload(false);
+        if (!liveConnected) {
+            location.reload(false);
+        }
     }, 300000);
+}
+
+function refreshBackground() {
+    var current = "";
+    var layers = document.querySelectorAll("#background .layer");
+    var front = 0;
+    var loading = {};
+
+    // preload loads urls into the browser's cache, then calls done
+    function preload(urls, done) {
+        var left = urls.length;
+        if (left == 0) {
+            done();
+            return;
+        }
+        urls.forEach(function(url) {
+            var img = new Image();
+            loading[url] = img;
+            img.onload = img.onerror = function() {
+                delete loading[url];
+                if (--left == 0) {
+                    done();
+                }
+            };
+            img.src = url;
+        });
+    }
+
+    function paint(layer, bg) {
+        var style = layer.style;
+        if (bg.fit == "pair" && bg.urls.length == 2) {
+            style.backgroundImage = "url(\"" + bg.urls[0] + "\"), url(\"" + bg.urls[1] + "\")";
+            style.backgroundSize = "auto 100%, auto 100%";
+            style.backgroundPosition = "left center, right center";
+        } else {
+            style.backgroundImage = "url(\"" + bg.url + "\")";
+            style.backgroundSize = bg.fit == "contain" ? "contain" : "cover";
+            style.backgroundPosition = "center center";
+        }
+    }
+
+    // kenBurns slowly zooms in towards a random point of a photo for as
+    // long as it is shown.  Photos shown whole aren't moved, as their edges
+    // would show.
+    function kenBurns(layer, bg) {
+        layer.style.animation = "none";
+        if (!bg.kenBurns || bg.fit != "cover" || !bg.duration) {
+            return;
+        }
+        layer.style.transformOrigin = Math.round(Math.random() * 100) + "% " + Math.round(Math.random() * 100) + "%";
+        void layer.offsetWidth;
+        layer.style.animation = "kenburns " + (bg.duration + (bg.transitionSeconds || 0)) + "s linear forwards";
+    }
+
+    function show(bg) {
+        preload(bg.urls || [bg.url], function() {
+            var prev = layers[front];
+            var next = layers[1 - front];
+            var seconds = bg.transition == "fade" ? (bg.transitionSeconds || 0) : 0;
+            paint(next, bg);
+            kenBurns(next, bg);
+            prev.style.transitionDuration = next.style.transitionDuration = seconds + "s";
+            next.classList.add("active");
+            prev.classList.remove("active");
+            front = 1 - front;
+            styleText(bg.text);
+            caption(bg.caption);
+        });
+    }
+
+    var panels = {
+        "header": "h1",
+        "weather": "#weather",
+        "left": "#left",
+        "right": "#right"
+    };
+
+    function styleText(text) {
+        for (var name in panels) {
+            var element = document.querySelector(panels[name]);
+            if (!element) {
+                continue;
+            }
+            element.classList.remove("text-light", "text-dark", "text-backdrop");
+            element.classList.add("text-" + ((text && text[name]) || "light"));
+        }
+    }
+
+    function caption(text) {
+        var element = document.getElementById("caption");
+        if (!element) {
+            return;
+        }
+        element.textContent = text || "";
+        element.style.display = text ? "block" : "none";
+    }
+
+    function update(bg) {
+        var key = bg.fit + " " + (bg.urls || [bg.url]).join(" ") + " " + JSON.stringify(bg.text) + " " + bg.caption;
+        if (bg.url && key != current) {
+            current = key;
+            show(bg);
+        }
+    }
+
+    function load() {
+        var request = new XMLHttpRequest();
+        request.onload = function() {
+            if (request.status == 200) {
+                update(JSON.parse(request.responseText));
+            }
+        };
+        request.open("GET", "/background");
+        request.send();
+    }
+
+    // updatePage replaces the panels with those of the newly written
+    // planner.html, leaving the clock and background alone.
+    function updatePage() {
+        var request = new XMLHttpRequest();
+        request.onload = function() {
+            if (request.status != 200) {
+                return;
+            }
+            var page = new DOMParser().parseFromString(request.responseText, "text/html");
+            ["weather", "left", "right"].forEach(function(id) {
+                var from = page.getElementById(id);
+                var to = document.getElementById(id);
+                if (from && to) {
+                    to.innerHTML = from.innerHTML;
+                }
+            });
+            updateEvents();
+        };
+        request.open("GET", "/");
+        request.send();
+    }
+
+    if (window.EventSource) {
+        var events = new EventSource("/events");
+        events.onopen = function() {
+            liveConnected = true;
+        };
+        events.onerror = function() {
+            liveConnected = false;
+        };
+        events.addEventListener("background", function(e) {
+            update(JSON.parse(e.data));
+        });
+        events.addEventListener("preload", function(e) {
+            preload(JSON.parse(e.data).urls || [], function() {});
+        });
+        events.addEventListener("page", updatePage);
+        events.addEventListener("auth", function(e) {
+            showAuthPrompt(JSON.parse(e.data));
+        });
+        events.addEventListener("reminders", function(e) {
+            showReminders(JSON.parse(e.data));
+        });
+    }
+
+    // Poll while the live channel is down
+    load();
+    setInterval(function() {
+        if (!liveConnected) {
+            load();
+        }
+    }, 10000);
+}
+
+// showAuthPrompt asks for Google Calendar to be connected, or hides the
+// request once it has been.
+function showAuthPrompt(prompt) {
+    var element = document.getElementById("authPrompt");
+    if (!element) {
+        return;
+    }
+    element.textContent = prompt.message || "";
+    if (prompt.url) {
+        var link = document.createElement("strong");
+        link.textContent = " " + prompt.url + " ";
+        element.appendChild(link);
+    }
+    if (prompt.code) {
+        element.appendChild(document.createTextNode("and enter "));
+        var code = document.createElement("strong");
+        code.className = "code";
+        code.textContent = prompt.code;
+        element.appendChild(code);
+    }
+    element.style.display = prompt.message ? "block" : "none";
+}
+
+// watchEvents keeps the events list current between calendar refreshes.
+function watchEvents() {
+    document.addEventListener("DOMContentLoaded", updateEvents);
+    setInterval(updateEvents, 30000);
+}
+
+// updateEvents highlights the events in progress, hides those that have
+// ended, and counts down to the next one.
+function updateEvents() {
+    var now = Date.now();
+    var next = null;
+    document.querySelectorAll("#eventList .event").forEach(function(item) {
+        var start = Number(item.dataset.start);
+        var end = Number(item.dataset.end);
+        item.classList.toggle("now", start <= now && now < end && !item.classList.contains("allDay"));
+        item.classList.toggle("past", end <= now && start < now);
+        if (start > now && (!next || start < Number(next.dataset.start))) {
+            next = item;
+        }
+    });
+
+    // Headings of days whose events have all ended go too
+    document.querySelectorAll("#eventList .eventDay").forEach(function(heading) {
+        var shown = false;
+        for (var item = heading.nextElementSibling; item && !item.classList.contains("eventDay"); item = item.nextElementSibling) {
+            shown = shown || !item.classList.contains("past");
+        }
+        heading.classList.toggle("past", !shown);
+    });
+
+    var element = document.getElementById("nextEvent");
+    if (element) {
+        element.textContent = next ? "Next: " + next.querySelector(".eventSummary").textContent + " " + countdown(Number(next.dataset.start) - now) : "";
+    }
+
+    document.querySelectorAll("#reminders .reminder").forEach(function(item) {
+        var start = Number(item.dataset.start);
+        item.querySelector(".countdown").textContent = start > now ? countdown(start - now) : "now";
+    });
+}
+
+// countdown is the same as countdown() in calendars.go.
+function countdown(ms) {
+    var minutes = Math.ceil(ms / 60000);
+    if (minutes <= 1) {
+        return "in a minute";
+    }
+    if (minutes < 60) {
+        return "in " + minutes + " min";
+    }
+    if (minutes < 24 * 60) {
+        return "in " + Math.floor(minutes / 60) + "h " + (minutes % 60) + "m";
+    }
+    var days = Math.floor(minutes / (24 * 60));
+    return days == 1 ? "in 1 day" : "in " + days + " days";
+}
+
+// remindersSeen are the reminders this page has already shown, keyed by
+// event, start and how far ahead each is due, so each chimes only once.
+var remindersSeen = {};
+
+// showReminders shows a banner across the screen for each event coming up.
+// Tapping one dismisses it everywhere.
+function showReminders(message) {
+    var element = document.getElementById("reminders");
+    if (!element) {
+        return;
+    }
+    element.innerHTML = "";
+    var fresh = false;
+    (message.reminders || []).forEach(function(r) {
+        var key = r.id + " " + r.start + " " + r.offset;
+        fresh = fresh || !remindersSeen[key];
+        remindersSeen[key] = true;
+
+        var item = document.createElement("div");
+        item.className = "reminder";
+        item.dataset.start = r.start;
+        item.style.borderLeftColor = r.colour;
+        var summary = document.createElement("strong");
+        summary.textContent = r.summary;
+        var when = document.createElement("span");
+        when.textContent = " " + r.when + " ";
+        var left = document.createElement("span");
+        left.className = "countdown";
+        var dismiss = document.createElement("span");
+        dismiss.className = "dismiss";
+        dismiss.textContent = "\u2715";
+        item.append(summary, when, left, dismiss);
+        item.addEventListener("click", function() {
+            item.remove();
+            var request = new XMLHttpRequest();
+            request.open("POST", "/reminders/dismiss");
+            request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+            request.send("id=" + encodeURIComponent(r.id));
+        });
+        element.appendChild(item);
+    });
+    updateEvents();
+    if (fresh && message.chime) {
+        chime();
+    }
+}
+
+// chime plays two soft notes.  Chromium only plays sound without a tap
+// first if started with --autoplay-policy=no-user-gesture-required.
+function chime() {
+    var Context = window.AudioContext || window.webkitAudioContext;
+    if (!Context) {
+        return;
+    }
+    var audio = new Context();
+    [659.25, 523.25].forEach(function(frequency, i) {
+        var start = audio.currentTime + i * 0.4;
+        var tone = audio.createOscillator();
+        var volume = audio.createGain();
+        tone.type = "sine";
+        tone.frequency.value = frequency;
+        volume.gain.setValueAtTime(0.3, start);
+        volume.gain.exponentialRampToValueAtTime(0.001, start + 1.2);
+        tone.connect(volume);
+        volume.connect(audio.destination);
+        tone.start(start);
+        tone.stop(start + 1.2);
+    });
+    setTimeout(function() {
+        audio.close();
+    }, 2500);
 }
\ No newline at end of file
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// panelRegion is where a panel of planner.html sits on the screen, as
+// fractions of its width and height.  These follow the layout in
+// css/planner.css.
+type panelRegion struct {
+	Name           string
+	X0, Y0, X1, Y1 float64
+}
+
+var panelRegions = []panelRegion{
+	{"header", 0, 0, 1, 0.1},
+	{"weather", 0, 0.1, 1, 0.42},
+	{"left", 0, 0.42, 0.55, 1},
+	{"right", 0.56, 0.42, 1, 1},
+}
+
+// Luminance thresholds for choosing text styles.  Above lightBackground
+// dark text reads best, below darkBackground light text does; anything in
+// between, or too busy to read over, gets a translucent backdrop.
+const (
+	lightBackground = 0.6
+	darkBackground  = 0.4
+	busyBackground  = 0.22
+)
+
+// textStyles returns "light", "dark" or "backdrop" for each panel, based on
+// the brightness of the part of the background behind it.  photos and fit
+// are as given to setBackground.
+func textStyles(config configStruct, fit string, photos []string) map[string]string {
+	styles := make(map[string]string)
+	for _, panel := range panelRegions {
+		styles[panel.Name] = "light"
+	}
+	if len(photos) == 0 {
+		return styles
+	}
+
+	canvas, err := renderBackground(config, fit, photos)
+	if err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Measuring brightness: "+err.Error()+"\n")
+		for _, panel := range panelRegions {
+			styles[panel.Name] = "backdrop"
+		}
+		return styles
+	}
+
+	b := canvas.Bounds()
+	for _, panel := range panelRegions {
+		r := image.Rect(
+			int(panel.X0*float64(b.Dx())), int(panel.Y0*float64(b.Dy())),
+			int(panel.X1*float64(b.Dx())), int(panel.Y1*float64(b.Dy())))
+		mean, stddev := luminance(canvas, r)
+		switch {
+		case stddev > busyBackground:
+			styles[panel.Name] = "backdrop"
+		case mean > lightBackground:
+			styles[panel.Name] = "dark"
+		case mean < darkBackground:
+			styles[panel.Name] = "light"
+		default:
+			styles[panel.Name] = "backdrop"
+		}
+	}
+	return styles
+}
+
+// renderBackground draws a small copy of the screen's background, laid out
+// the way js/planner.js shows it for fit.
+func renderBackground(config configStruct, fit string, photos []string) (*image.RGBA, error) {
+	w, h := 96, 54
+	if config.DisplayWidth > 0 && config.DisplayHeight > 0 {
+		h = w * config.DisplayHeight / config.DisplayWidth
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(canvas, canvas.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	for i, photo := range photos {
+		img, err := loadBackgroundImage(config, photo)
+		if err != nil {
+			return nil, err
+		}
+		src := img.Bounds()
+		iw, ih := float64(src.Dx()), float64(src.Dy())
+		switch {
+		case fit == "pair":
+			// Each photo full height, one at each side
+			dw := int(iw / ih * float64(h))
+			dest := image.Rect(0, 0, dw, h)
+			if i == 1 {
+				dest = image.Rect(w-dw, 0, w, h)
+			}
+			draw.ApproxBiLinear.Scale(canvas, dest, img, src, draw.Over, nil)
+		case fit == "contain":
+			scale := math.Min(float64(w)/iw, float64(h)/ih)
+			dw, dh := int(iw*scale), int(ih*scale)
+			dest := image.Rect((w-dw)/2, (h-dh)/2, (w-dw)/2+dw, (h-dh)/2+dh)
+			draw.ApproxBiLinear.Scale(canvas, dest, img, src, draw.Over, nil)
+		default:
+			// cover: crop the middle of the photo to the screen's shape
+			scale := math.Max(float64(w)/iw, float64(h)/ih)
+			cw, ch := int(float64(w)/scale), int(float64(h)/scale)
+			x0, y0 := src.Min.X+(src.Dx()-cw)/2, src.Min.Y+(src.Dy()-ch)/2
+			draw.ApproxBiLinear.Scale(canvas, canvas.Bounds(), img, image.Rect(x0, y0, x0+cw, y0+ch), draw.Over, nil)
+		}
+	}
+	return canvas, nil
+}
+
+// loadBackgroundImage decodes photo upright, preferring its small cached
+// copy to the full-size original.
+func loadBackgroundImage(config configStruct, photo string) (image.Image, error) {
+	file := cachedPhoto(config, photo)
+	if file == "" {
+		file = filepath.Join(config.PhotosDir, filepath.FromSlash(photo))
+	}
+	meta, err := readPhotoMeta(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Orientation > 1 {
+		// Shrink first so turning it upright is quick
+		small := image.NewRGBA(image.Rect(0, 0, 256, 256*img.Bounds().Dy()/img.Bounds().Dx()))
+		draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+		return orientImage(small, meta.Orientation), nil
+	}
+	return img, nil
+}
+
+// luminance returns the mean and standard deviation of the perceived
+// lightness, from 0 for black to 1 for white, of the pixels in r.
+func luminance(img image.Image, r image.Rectangle) (float64, float64) {
+	var sum, sumSq float64
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			l := lightness(0.2126*linear(c.R) + 0.7152*linear(c.G) + 0.0722*linear(c.B))
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	mean := sum / float64(n)
+	return mean, math.Sqrt(math.Max(sumSq/float64(n)-mean*mean, 0))
+}
+
+// lightness converts relative luminance to CIE L*, scaled to 0..1, so that
+// equal steps look equally different.
+func lightness(y float64) float64 {
+	if y <= 216.0/24389 {
+		return y * 24389 / 27 / 100
+	}
+	return (116*math.Cbrt(y) - 16) / 100
+}
+
+// linear converts an sRGB channel value to linear light.
+func linear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// liveClients are the pages connected to /events.  Each gets the events
+// published while it is connected, as Server-Sent Events.
+var liveClients struct {
+	sync.Mutex
+	clients map[chan []byte]bool
+}
+
+// liveSticky holds the last message of each event published with
+// publishSticky, which every page is sent as soon as it connects.
+var liveSticky struct {
+	sync.Mutex
+	messages map[string][]byte
+}
+
+// liveHeartbeat is how often an idle connection is sent a comment, so
+// proxies and the browser don't give up on it.
+const liveHeartbeat = 30 * time.Second
+
+// publish sends event to every connected page, with data encoded as JSON.
+// A page too slow to keep up misses the event rather than holding up the
+// others.
+func publish(event string, data interface{}) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Encoding "+event+" event: "+err.Error()+"\n")
+		return
+	}
+	send(liveMessage(event, dataBytes))
+}
+
+// publishSticky is publish for state rather than news, such as a prompt to
+// sign in: pages that connect later are sent the last one too.
+func publishSticky(event string, data interface{}) {
+	if message := keepSticky(event, data); message != nil {
+		send(message)
+	}
+}
+
+// keepSticky stores data as the message of event that pages connecting
+// later are sent, without sending it now, and returns the message.
+func keepSticky(event string, data interface{}) []byte {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Encoding "+event+" event: "+err.Error()+"\n")
+		return nil
+	}
+	message := liveMessage(event, dataBytes)
+	liveSticky.Lock()
+	if liveSticky.messages == nil {
+		liveSticky.messages = make(map[string][]byte)
+	}
+	liveSticky.messages[event] = message
+	liveSticky.Unlock()
+	return message
+}
+
+func liveMessage(event string, data []byte) []byte {
+	return []byte("event: " + event + "\ndata: " + string(data) + "\n\n")
+}
+
+func send(message []byte) {
+	liveClients.Lock()
+	defer liveClients.Unlock()
+	for client := range liveClients.clients {
+		select {
+		case client <- message:
+		default:
+		}
+	}
+}
+
+// serveEvents streams published events to a page until it disconnects,
+// starting with the current background so a page that has just connected
+// doesn't have to ask for it.
+func serveEvents(w http.ResponseWriter, r *http.Request, config configStruct) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	client := make(chan []byte, 8)
+	liveClients.Lock()
+	if liveClients.clients == nil {
+		liveClients.clients = make(map[chan []byte]bool)
+	}
+	liveClients.clients[client] = true
+	liveClients.Unlock()
+	defer func() {
+		liveClients.Lock()
+		delete(liveClients.clients, client)
+		liveClients.Unlock()
+	}()
+
+	current, _ := json.Marshal(backgroundMessage(config))
+	io.WriteString(w, "retry: 5000\n")
+	w.Write(liveMessage("background", current))
+	liveSticky.Lock()
+	for _, message := range liveSticky.messages {
+		w.Write(message)
+	}
+	liveSticky.Unlock()
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case message := <-client:
+			if _, err := w.Write(message); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// watchPage tells connected pages when planner.html has been rewritten with
+// new weather, words or events, so they can update in place instead of
+// reloading and interrupting the photo transitions.
+func watchPage(config configStruct) {
+	var last time.Time
+	if info, err := os.Stat(config.HTMLFile); err == nil {
+		last = info.ModTime()
+	}
+	check := checkInterval(config)
+	if check <= 0 {
+		check = time.Minute
+	}
+	for range time.Tick(check) {
+		info, err := os.Stat(config.HTMLFile)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+		publish("page", struct{}{})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strings"
+)
+
+// mwLinkURL is where cross-references in a definition point.
+const mwLinkURL = "https://www.merriam-webster.com/dictionary/"
+
+// mwTags maps Merriam-Webster markup, both the <tag> form of the XML API and
+// the {tag} form of the JSON API, to the HTML it is rendered as.  Markup not
+// listed here (and not a cross-reference) is dropped, keeping its text.
+var mwTags = map[string][2]string{
+	"it":     {"<i>", "</i>"},
+	"wi":     {"<i>", "</i>"},
+	"qword":  {"<i>", "</i>"},
+	"b":      {"<b>", "</b>"},
+	"phrase": {"<b><i>", "</i></b>"},
+	"sc":     {"<span class=\"sc\">", "</span>"},
+	"inf":    {"<sub>", "</sub>"},
+	"sup":    {"<sup>", "</sup>"},
+	"vi":     {"<span class=\"vi\">&lt;", "&gt;</span>"},
+	"gloss":  {"[", "]"},
+	"dx":     {" &mdash; ", ""},
+	"dx_def": {"(", ")"},
+	"dx_ety": {" &mdash; ", ""},
+	"ma":     {" &mdash; more at ", ""},
+	"un":     {" &mdash; ", ""},
+	"snote":  {" &mdash; ", ""},
+	"ssl":    {"<i>", "</i>"},
+	"wsgram": {"[", "]"},
+	"fw":     {"<i>", "</i>"},
+	"cat":    {"<i>", "</i>"},
+	"sd":     {"<i>", "</i>"},
+	"aq":     {" &mdash; ", ""},
+	"bnote":  {"<b>", "</b>"},
+	"note":   {" &mdash; ", ""},
+	"parahw": {"<b>", "</b>"},
+}
+
+// mwEntities are the self-contained {tokens} of the JSON API.
+var mwEntities = map[string]string{
+	"ldquo": "&ldquo;",
+	"rdquo": "&rdquo;",
+	"p_br":  "<br>",
+}
+
+// mwFormatter turns one definition's worth of dictionary markup into HTML.
+// Text is always escaped; the only tags in the output are the ones it
+// writes itself, and every tag it opens is closed.
+type mwFormatter struct {
+	out    strings.Builder
+	open   []string
+	senses int
+	colons bool
+}
+
+// formatDefinition converts a Merriam-Webster definition, as raw inner XML
+// of a <dt> element or as JSON API {markup}, into safe HTML with italics,
+// small caps and cross-reference links.
+func formatDefinition(raw string) string {
+	f := mwFormatter{colons: !strings.Contains(raw, "{bc}")}
+	for len(raw) > 0 {
+		switch raw[0] {
+		case '<':
+			end := strings.IndexByte(raw, '>')
+			if end == -1 {
+				f.text(raw)
+				raw = ""
+				continue
+			}
+			tag := raw[1:end]
+			raw = raw[end+1:]
+			if tag == "sx" || strings.HasPrefix(tag, "sx ") {
+				raw = f.xmlCrossRef(raw)
+				continue
+			}
+			f.xmlTag(tag)
+		case '{':
+			end := strings.IndexByte(raw, '}')
+			if end == -1 {
+				f.text(raw)
+				raw = ""
+				continue
+			}
+			f.jsonToken(raw[1:end])
+			raw = raw[end+1:]
+		default:
+			next := strings.IndexAny(raw, "<{")
+			if next == -1 {
+				next = len(raw)
+			}
+			f.text(raw[:next])
+			raw = raw[next:]
+		}
+	}
+	for len(f.open) > 0 {
+		f.close(f.open[len(f.open)-1])
+	}
+	return strings.TrimSpace(strings.Join(strings.Fields(f.out.String()), " "))
+}
+
+// text writes s escaped.  In XML API markup a colon marks the start of a
+// sense: the first is dropped and later ones become semicolons.
+func (f *mwFormatter) text(s string) {
+	s = html.UnescapeString(s)
+	for f.colons {
+		colon := strings.IndexByte(s, ':')
+		if colon == -1 {
+			break
+		}
+		f.out.WriteString(html.EscapeString(s[:colon]))
+		f.senseBreak()
+		s = s[colon+1:]
+	}
+	f.out.WriteString(html.EscapeString(s))
+}
+
+func (f *mwFormatter) senseBreak() {
+	if f.senses > 0 {
+		written := strings.TrimRight(f.out.String(), " \t\n")
+		f.out.Reset()
+		f.out.WriteString(written + "; ")
+	}
+	f.senses++
+}
+
+func (f *mwFormatter) xmlTag(tag string) {
+	tag = strings.TrimSpace(tag)
+	if strings.HasSuffix(tag, "/") {
+		return
+	}
+	if strings.HasPrefix(tag, "/") {
+		f.close(strings.TrimPrefix(tag, "/"))
+		return
+	}
+	if space := strings.IndexAny(tag, " \t\n"); space != -1 {
+		tag = tag[:space]
+	}
+	f.openTag(tag)
+}
+
+// xmlCrossRef renders an <sx>word<sxn>2</sxn></sx> cross-reference, whose
+// opening tag has already been consumed, and returns the rest of raw.
+func (f *mwFormatter) xmlCrossRef(raw string) string {
+	inner, rest := raw, ""
+	if end := strings.Index(raw, "</sx>"); end != -1 {
+		inner, rest = raw[:end], raw[end+len("</sx>"):]
+	}
+
+	word, sense := inner, ""
+	if sxn := strings.Index(inner, "<sxn>"); sxn != -1 {
+		word = inner[:sxn]
+		sense = stripTags(inner[sxn:])
+	}
+	word = html.UnescapeString(stripTags(word))
+	f.link(word, word, sense)
+	return rest
+}
+
+func (f *mwFormatter) jsonToken(token string) {
+	fields := strings.Split(token, "|")
+	name := fields[0]
+	switch name {
+	case "bc":
+		f.senseBreak()
+		return
+	case "sx", "a_link", "i_link":
+		if len(fields) > 1 {
+			sense := ""
+			if len(fields) > 3 {
+				sense = fields[3]
+			}
+			target := fields[1]
+			if len(fields) > 2 && fields[2] != "" {
+				target = fields[2]
+			}
+			if name == "i_link" {
+				f.out.WriteString("<i>")
+				f.link(fields[1], target, sense)
+				f.out.WriteString("</i>")
+				return
+			}
+			if name == "sx" {
+				f.out.WriteString("<span class=\"sc\">")
+				f.link(fields[1], target, sense)
+				f.out.WriteString("</span>")
+				return
+			}
+			f.link(fields[1], target, sense)
+		}
+		return
+	case "d_link", "et_link", "mat", "dxt":
+		if len(fields) > 1 {
+			target := fields[1]
+			if len(fields) > 2 && fields[2] != "" {
+				target = fields[2]
+			}
+			sense := ""
+			if name == "dxt" && len(fields) > 3 {
+				sense = fields[3]
+			}
+			f.link(fields[1], target, sense)
+		}
+		return
+	}
+	if entity, ok := mwEntities[name]; ok {
+		f.out.WriteString(entity)
+		return
+	}
+	if strings.HasPrefix(name, "/") {
+		f.close(strings.TrimPrefix(name, "/"))
+		return
+	}
+	f.openTag(name)
+}
+
+// link writes a cross-reference to target labelled display, followed by its
+// sense number if there is one.  Homograph suffixes such as "shelter:1" are
+// dropped from both.
+func (f *mwFormatter) link(display string, target string, sense string) {
+	display = stripHomograph(strings.TrimSpace(display))
+	target = stripHomograph(strings.TrimSpace(target))
+	if display == "" {
+		return
+	}
+	f.out.WriteString("<a class=\"xref\" href=\"" + mwLinkURL + url.PathEscape(target) + "\">")
+	f.out.WriteString(html.EscapeString(display))
+	f.out.WriteString("</a>")
+	if sense = strings.TrimSpace(sense); sense != "" {
+		f.out.WriteString(" " + html.EscapeString(sense))
+	}
+}
+
+func (f *mwFormatter) openTag(name string) {
+	tag, ok := mwTags[name]
+	if !ok {
+		return
+	}
+	f.out.WriteString(tag[0])
+	f.open = append(f.open, name)
+}
+
+// close closes name and anything opened inside it.  A closing tag that was
+// never opened is ignored.
+func (f *mwFormatter) close(name string) {
+	for i := len(f.open) - 1; i >= 0; i-- {
+		if f.open[i] != name {
+			continue
+		}
+		for j := len(f.open) - 1; j >= i; j-- {
+			f.out.WriteString(mwTags[f.open[j]][1])
+		}
+		f.open = f.open[:i]
+		return
+	}
+}
+
+func stripHomograph(s string) string {
+	if colon := strings.IndexByte(s, ':'); colon != -1 {
+		return s[:colon]
+	}
+	return s
+}
+
+func stripTags(s string) string {
+	return tagPattern.ReplaceAllString(s, "")
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestFormatDefinition(t *testing.T) {
+	xref := func(word string) string {
+		return `<a class="xref" href="https://www.merriam-webster.com/dictionary/` + word + `">` + word + `</a>`
+	}
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "json senses and italics",
+			raw:  "{bc}the faculty or phenomenon of finding valuable or agreeable things not sought for; {it}also{/it} {bc}an instance of this",
+			want: "the faculty or phenomenon of finding valuable or agreeable things not sought for; <i>also</i>; an instance of this",
+		},
+		{
+			name: "json synonym cross-reference",
+			raw:  "{bc}given to fluent or excessive talk {bc}{sx|garrulous||}",
+			want: `given to fluent or excessive talk; <span class="sc">` + xref("garrulous") + `</span>`,
+		},
+		{
+			name: "json cross-reference with homograph and sense",
+			raw:  "{bc}{sx|erudite||} {bc}{sx|pedantic:1||2}",
+			want: `<span class="sc">` + xref("erudite") + `</span>; <span class="sc">` + xref("pedantic") + ` 2</span>`,
+		},
+		{
+			name: "json directional cross-reference",
+			raw:  "{bc}a written or printed representation {dx}see also {dxt|script||}{/dx}",
+			want: "a written or printed representation &mdash; see also " + xref("script"),
+		},
+		{
+			name: "json small caps",
+			raw:  "{bc}a cardinal number equal to {sc}one hundred{/sc}",
+			want: `a cardinal number equal to <span class="sc">one hundred</span>`,
+		},
+		{
+			name: "json label before synonym",
+			raw:  "{bc}{it}chiefly British{/it} {bc}{sx|fortnight||}",
+			want: `<i>chiefly British</i>; <span class="sc">` + xref("fortnight") + `</span>`,
+		},
+		{
+			name: "json unclosed italics",
+			raw:  "{bc}{it}sotto voce",
+			want: "<i>sotto voce</i>",
+		},
+		{
+			name: "json text escaped",
+			raw:  "{bc}less than 1 < 2 & \"quoted\"",
+			want: "less than 1 &lt; 2 &amp; &#34;quoted&#34;",
+		},
+		{
+			name: "xml senses and cross-reference",
+			raw:  ":having or showing great knowledge or learning :<sx>erudite</sx>",
+			want: "having or showing great knowledge or learning; " + xref("erudite"),
+		},
+		{
+			name: "xml italics and sense number",
+			raw:  ":a <it>sudden</it> and <sx>abrupt<sxn>2</sxn></sx> change",
+			want: "a <i>sudden</i> and " + xref("abrupt") + " 2 change",
+		},
+		{
+			name: "xml entities and unknown tags",
+			raw:  ":salt &amp; pepper <script>alert(1)</script>",
+			want: "salt &amp; pepper alert(1)",
+		},
+	}
+	for _, test := range tests {
+		if got := formatDefinition(test.raw); got != test.want {
+			t.Errorf("%s: formatDefinition(%q)\n got %q\nwant %q", test.name, test.raw, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// photoIndex is the in-memory list of usable photos in config.PhotosDir,
+// as paths relative to it.  It is kept up to date by watchPhotos, so the
+// photo schedulers don't walk the whole folder every time.
+var photoIndex struct {
+	sync.Mutex
+	photos map[string]bool
+	ready  bool
+}
+
+// photoSettle is how long a new or changed file must be left alone before
+// it is indexed, so a photo still being copied in isn't picked up half
+// written.
+const photoSettle = 2 * time.Second
+
+// photoRescan is how often the whole folder is walked even while it is
+// being watched, in case an event was missed.
+const photoRescan = time.Hour
+
+// indexedPhotos returns the photos in the index, sorted, scanning
+// config.PhotosDir first if watchPhotos hasn't yet.
+func indexedPhotos(config configStruct) []string {
+	photoIndex.Lock()
+	ready := photoIndex.ready
+	photoIndex.Unlock()
+	if !ready {
+		rescanPhotos(config)
+	}
+
+	photoIndex.Lock()
+	defer photoIndex.Unlock()
+	photos := make([]string, 0, len(photoIndex.photos))
+	for photo := range photoIndex.photos {
+		photos = append(photos, photo)
+	}
+	sort.Strings(photos)
+	return photos
+}
+
+func indexedCount() int {
+	photoIndex.Lock()
+	defer photoIndex.Unlock()
+	return len(photoIndex.photos)
+}
+
+// photoExists reports whether photo is still on disk, dropping it from the
+// index if it isn't.
+func photoExists(config configStruct, photo string) bool {
+	if _, err := os.Stat(filepath.Join(config.PhotosDir, filepath.FromSlash(photo))); err == nil {
+		return true
+	}
+	photoIndex.Lock()
+	delete(photoIndex.photos, photo)
+	photoIndex.Unlock()
+	return false
+}
+
+// rescanPhotos replaces the index with a fresh walk of config.PhotosDir.
+func rescanPhotos(config configStruct) {
+	photos, err := listPhotos(config.PhotosDir)
+	if err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Error reading "+config.PhotosDir+": "+err.Error()+"\n")
+	}
+	index := make(map[string]bool, len(photos))
+	for _, photo := range photos {
+		index[photo] = true
+	}
+	photoIndex.Lock()
+	photoIndex.photos = index
+	photoIndex.ready = true
+	photoIndex.Unlock()
+}
+
+// watchPhotos keeps the photo index up to date.  It uses inotify where it
+// can; if config.PhotoWatch is off, as it should be for network shares
+// whose changes inotify doesn't see, or the folder can't be watched, it
+// falls back to rescanning every config.PhotoPollInterval seconds.
+func watchPhotos(config configStruct) {
+	rescanPhotos(config)
+
+	if !config.PhotoWatch {
+		pollPhotos(config)
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Can't watch "+config.PhotosDir+", polling instead: "+err.Error()+"\n")
+		pollPhotos(config)
+		return
+	}
+	defer watcher.Close()
+	if err := watchTree(watcher, config.PhotosDir); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Can't watch "+config.PhotosDir+", polling instead: "+err.Error()+"\n")
+		pollPhotos(config)
+		return
+	}
+	logger("photo", time.Now().Format(time.RFC850)+"  INFO: Watching "+config.PhotosDir+" for new photos\n")
+
+	pending := make(map[string]time.Time)
+	settle := time.NewTicker(photoSettle / 2)
+	defer settle.Stop()
+	rescan := time.NewTicker(photoRescan)
+	defer rescan.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Can't watch "+event.Name+": "+err.Error()+"\n")
+					}
+					rescanPhotos(config)
+					continue
+				}
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				removePhotos(config, event.Name)
+				continue
+			}
+			pending[event.Name] = time.Now()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Usually an overflowed event queue, so start again from disk
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Watching "+config.PhotosDir+": "+err.Error()+"\n")
+			rescanPhotos(config)
+		case <-settle.C:
+			for file, changed := range pending {
+				if time.Since(changed) >= photoSettle {
+					delete(pending, file)
+					addPhoto(config, file)
+				}
+			}
+		case <-rescan.C:
+			rescanPhotos(config)
+		}
+	}
+}
+
+func pollPhotos(config configStruct) {
+	interval := config.PhotoPollInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	logger("photo", time.Now().Format(time.RFC850)+"  INFO: Checking "+config.PhotosDir+" for new photos every "+strconv.Itoa(interval)+" seconds\n")
+	for range time.Tick(time.Second * time.Duration(interval)) {
+		before := indexedCount()
+		rescanPhotos(config)
+		if after := indexedCount(); after != before {
+			logger("photo", time.Now().Format(time.RFC850)+"  INFO: "+config.PhotosDir+" now has "+strconv.Itoa(after)+" photos\n")
+		}
+	}
+}
+
+// watchTree watches dir and every folder beneath it, skipping hidden ones
+// as listPhotos does.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// addPhoto indexes a new or changed file if it is a usable photo, scaling
+// it for the display straight away.
+func addPhoto(config configStruct, file string) {
+	rel, err := filepath.Rel(config.PhotosDir, file)
+	if err != nil {
+		return
+	}
+	photo := filepath.ToSlash(rel)
+	for _, part := range strings.Split(photo, "/") {
+		if strings.HasPrefix(part, ".") {
+			return
+		}
+	}
+	info, err := os.Stat(file)
+	kind := photoType(file)
+	if err != nil || !info.Mode().IsRegular() || kind == "" || (kind == "heic" && !heicDecodable) {
+		removePhotos(config, file)
+		return
+	}
+
+	photoIndex.Lock()
+	added := !photoIndex.photos[photo]
+	photoIndex.photos[photo] = true
+	photoIndex.Unlock()
+	if added {
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: New photo "+photo+"\n")
+	}
+	if cacheEnabled(config) {
+		if _, made, err := cachePhoto(config, photo); err != nil {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Caching "+photo+": "+err.Error()+"\n")
+		} else if made {
+			saveCacheIndex(config)
+		}
+	}
+}
+
+// removePhotos drops file from the index, or everything under it if it was
+// a folder.
+func removePhotos(config configStruct, file string) {
+	rel, err := filepath.Rel(config.PhotosDir, file)
+	if err != nil {
+		return
+	}
+	prefix := filepath.ToSlash(rel)
+	photoIndex.Lock()
+	defer photoIndex.Unlock()
+	for photo := range photoIndex.photos {
+		if photo == prefix || strings.HasPrefix(photo, prefix+"/") {
+			delete(photoIndex.photos, photo)
+			logger("photo", time.Now().Format(time.RFC850)+"  INFO: Photo "+photo+" removed\n")
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// photoDeck is the shuffled playlist of background photos.  Every photo is
+// shown, as many times as its weight, before the deck is reshuffled.  The
+// deck and position are saved to config.PhotoDeckFile so a restart carries
+// on where it left off.
+type photoDeck struct {
+	Photos   []string `json:"photos"`
+	Position int      `json:"position"`
+}
+
+// photoExtensions are the file extensions listPhotos considers, by image type.
+var photoExtensions = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".jpe":  "jpeg",
+	".png":  "png",
+	".webp": "webp",
+	".heic": "heic",
+	".heif": "heic",
+}
+
+// heicDecodable is false because neither the Go standard library nor
+// Chromium on the Pi can decode HEIC, so such photos are skipped.
+const heicDecodable = false
+
+// listPhotos returns every usable image under dir, searching subfolders, as
+// paths relative to dir.  Hidden files and folders are ignored.
+func listPhotos(dir string) ([]string, error) {
+	var photos []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		kind := photoType(path)
+		if kind == "" {
+			return nil
+		}
+		if kind == "heic" && !heicDecodable {
+			logger("photo", time.Now().Format(time.RFC850)+"  INFO: Skipping "+path+", HEIC photos can't be displayed\n")
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		photos = append(photos, filepath.ToSlash(rel))
+		return nil
+	})
+	return photos, err
+}
+
+// photoType returns "jpeg", "png", "webp" or "heic" if path has one of
+// those extensions and its contents start with the matching magic bytes,
+// and "" otherwise.
+func photoType(path string) string {
+	kind := photoExtensions[strings.ToLower(filepath.Ext(path))]
+	if kind == "" {
+		return ""
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return ""
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return matchType(kind, "jpeg")
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return matchType(kind, "png")
+	case bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return matchType(kind, "webp")
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		switch string(header[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return matchType(kind, "heic")
+		}
+	}
+	return ""
+}
+
+// matchType returns the type found from a photo's contents, logging when
+// its extension says otherwise.  A photo whose extension is merely wrong,
+// such as a PNG saved as .jpg, is still usable.
+func matchType(kind string, contents string) string {
+	if kind != contents {
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: "+kind+" extension on a "+contents+" file\n")
+	}
+	return contents
+}
+
+// nextPhoto advances the saved deck and returns the photo to show, or "" if
+// photos is empty.  Photos that have disappeared are dropped from the deck
+// and new ones are shuffled into the part not yet shown.
+func nextPhoto(config configStruct, photos []string) string {
+	return nextPhotoWhere(config, photos, nil)
+}
+
+// nextPhotoWhere is nextPhoto, but takes the next photo in the deck for
+// which want returns true, moving it forward to be shown now.  It returns ""
+// without advancing the deck if no photo left in this round is wanted.
+func nextPhotoWhere(config configStruct, photos []string, want func(string) bool) string {
+	if len(photos) == 0 {
+		return ""
+	}
+	deck := loadDeck(config.PhotoDeckFile)
+	deck.update(photos, config)
+
+	if deck.Position >= len(deck.Photos) {
+		last := ""
+		if len(deck.Photos) > 0 {
+			last = deck.Photos[len(deck.Photos)-1]
+		}
+		deck.Photos = shuffleDeck(photos, config, last)
+		deck.Position = 0
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: Reshuffled deck of "+strconv.Itoa(len(deck.Photos))+" photos\n")
+	}
+	if len(deck.Photos) == 0 {
+		return ""
+	}
+
+	found := deck.Position
+	for want != nil && found < len(deck.Photos) && !want(deck.Photos[found]) {
+		found++
+	}
+	if found == len(deck.Photos) {
+		return ""
+	}
+	photo := deck.Photos[found]
+	copy(deck.Photos[deck.Position+1:found+1], deck.Photos[deck.Position:found])
+	deck.Photos[deck.Position] = photo
+
+	deck.Position++
+	if err := deck.save(config.PhotoDeckFile); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Saving "+config.PhotoDeckFile+": "+err.Error()+"\n")
+	}
+	return photo
+}
+
+// upcomingPhotos are the photos chosen to be shown next.  They are sent to
+// the page ahead of time so it can load them before they are needed.
+var upcomingPhotos struct {
+	sync.Mutex
+	fit    string
+	photos []string
+}
+
+// pickPhotos chooses photos with choosePhotos, passing over any that have
+// been deleted since the photo index last heard of them.
+func pickPhotos(config configStruct) (string, []string) {
+	fit, chosen := choosePhotos(config, indexedPhotos(config))
+	for tries := 0; tries < 5 && len(chosen) > 0; tries++ {
+		gone := false
+		for _, photo := range chosen {
+			if !photoExists(config, photo) {
+				logger("photo", time.Now().Format(time.RFC850)+"  INFO: "+photo+" has been removed, choosing another\n")
+				gone = true
+			}
+		}
+		if !gone {
+			break
+		}
+		fit, chosen = choosePhotos(config, indexedPhotos(config))
+	}
+	return fit, chosen
+}
+
+// setUpcoming remembers the next photos and tells the page to preload them.
+func setUpcoming(config configStruct, fit string, photos []string) {
+	upcomingPhotos.Lock()
+	upcomingPhotos.fit, upcomingPhotos.photos = fit, photos
+	upcomingPhotos.Unlock()
+
+	urls := []string{}
+	for _, photo := range photos {
+		urls = append(urls, photoURL(photo))
+	}
+	publish("preload", struct {
+		URLs []string `json:"urls"`
+	}{urls})
+}
+
+// takeUpcoming returns the photos chosen by setUpcoming, unless one of them
+// has since been deleted.
+func takeUpcoming(config configStruct) (string, []string) {
+	upcomingPhotos.Lock()
+	fit, photos := upcomingPhotos.fit, upcomingPhotos.photos
+	upcomingPhotos.fit, upcomingPhotos.photos = "", nil
+	upcomingPhotos.Unlock()
+	for _, photo := range photos {
+		if !photoExists(config, photo) {
+			return "", nil
+		}
+	}
+	return fit, photos
+}
+
+// maxCoverCrop is the largest fraction of a photo that may be cropped away
+// to fill the display before the photo is considered not to suit it.
+const maxCoverCrop = 1.0 / 3
+
+// choosePhotos picks the next background and how to fit it, following
+// config.PhotoFit for photos whose shape doesn't suit the display:
+// "letterbox" shows them whole, "skip" passes over them for one that does
+// suit, and "pair" puts two portrait photos side by side on a landscape
+// display.  With "cover", or no display size configured, every photo is
+// cropped to fill the screen.  Photos taken on this day in earlier years
+// come before the deck.
+func choosePhotos(config configStruct, photos []string) (string, []string) {
+	photo := onThisDayPhoto(config, photos)
+	if photo == "" {
+		photo = nextPhoto(config, photos)
+	}
+	if photo == "" {
+		return "", nil
+	}
+	if config.DisplayWidth <= 0 || config.DisplayHeight <= 0 || config.PhotoFit == "" || config.PhotoFit == "cover" {
+		return "cover", []string{photo}
+	}
+
+	meta := func(p string) (photoMeta, bool) {
+		m, err := cachedPhotoMeta(filepath.Join(config.PhotosDir, filepath.FromSlash(p)))
+		if err != nil {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Reading size of "+p+": "+err.Error()+"\n")
+			return m, false
+		}
+		return m, true
+	}
+	suits := func(p string) bool {
+		m, ok := meta(p)
+		return ok && suitsDisplay(m, config)
+	}
+
+	m, ok := meta(photo)
+	if !ok || suitsDisplay(m, config) {
+		return "cover", []string{photo}
+	}
+
+	switch config.PhotoFit {
+	case "skip":
+		logger("photo", time.Now().Format(time.RFC850)+"  INFO: Skipping "+photo+", it doesn't suit the display\n")
+		if next := nextPhotoWhere(config, photos, suits); next != "" {
+			return "cover", []string{next}
+		}
+	case "pair":
+		displayPortrait := config.DisplayHeight > config.DisplayWidth
+		if m.portrait() && !displayPortrait {
+			partner := nextPhotoWhere(config, photos, func(p string) bool {
+				pm, ok := meta(p)
+				return ok && pm.portrait()
+			})
+			if partner != "" {
+				return "pair", []string{photo, partner}
+			}
+		}
+	}
+	return "contain", []string{photo}
+}
+
+// suitsDisplay reports whether a photo can be cropped to fill the display
+// without losing more than maxCoverCrop of it.
+func suitsDisplay(m photoMeta, config configStruct) bool {
+	if m.Width <= 0 || m.Height <= 0 {
+		return true
+	}
+	r := (float64(m.Width) / float64(m.Height)) / (float64(config.DisplayWidth) / float64(config.DisplayHeight))
+	if r > 1 {
+		r = 1 / r
+	}
+	return 1-r <= maxCoverCrop
+}
+
+// update reconciles the deck with the photos currently on disk.
+func (d *photoDeck) update(photos []string, config configStruct) {
+	present := make(map[string]bool, len(photos))
+	for _, p := range photos {
+		present[p] = true
+	}
+
+	inDeck := make(map[string]bool, len(d.Photos))
+	kept := d.Photos[:0]
+	position := d.Position
+	for i, p := range d.Photos {
+		if !present[p] {
+			if i < d.Position {
+				position--
+			}
+			continue
+		}
+		inDeck[p] = true
+		kept = append(kept, p)
+	}
+	d.Photos, d.Position = kept, position
+	if d.Position < 0 {
+		d.Position = 0
+	}
+	if d.Position > len(d.Photos) {
+		d.Position = len(d.Photos)
+	}
+
+	// New photos go into the not-yet-shown part of the deck.  An empty deck
+	// is left for nextPhoto to shuffle from scratch.
+	if len(d.Photos) == 0 {
+		return
+	}
+	for _, p := range photos {
+		if inDeck[p] {
+			continue
+		}
+		for n := photoWeight(p, config); n > 0; n-- {
+			at := d.Position + rand.Intn(len(d.Photos)-d.Position+1)
+			d.Photos = append(d.Photos, "")
+			copy(d.Photos[at+1:], d.Photos[at:])
+			d.Photos[at] = p
+		}
+	}
+}
+
+// shuffleDeck returns a new deck holding each photo as many times as its
+// weight, in random order but with copies of the same photo kept apart
+// wherever the weights allow it.  last is the photo shown just before the
+// new deck starts, so it is not repeated across the reshuffle either.
+func shuffleDeck(photos []string, config configStruct, last string) []string {
+	remaining := make(map[string]int)
+	total := 0
+	for _, p := range photos {
+		if w := photoWeight(p, config); w > 0 {
+			remaining[p] = w
+			total += w
+		}
+	}
+
+	deck := make([]string, 0, total)
+	prev := last
+	for ; total > 0; total-- {
+		// The most common photo must be placed now if the others are too
+		// few to separate its remaining copies.
+		most, mostCount := "", 0
+		for _, p := range photos {
+			if remaining[p] > mostCount && p != prev {
+				most, mostCount = p, remaining[p]
+			}
+		}
+		pick := most
+		if others := total - remaining[prev]; others > 0 && mostCount <= total-mostCount {
+			n := rand.Intn(others)
+			for _, p := range photos {
+				if p == prev {
+					continue
+				}
+				if n < remaining[p] {
+					pick = p
+					break
+				}
+				n -= remaining[p]
+			}
+		}
+		if pick == "" {
+			for _, p := range photos {
+				if remaining[p] > 0 {
+					pick = p
+					break
+				}
+			}
+		}
+		deck = append(deck, pick)
+		remaining[pick]--
+		prev = pick
+	}
+	return deck
+}
+
+// photoWeight is how many times photo appears in each deck.  An entry in
+// config.PhotoWeights for the file, or for the closest folder containing
+// it, wins; otherwise photos in a favourites folder get
+// config.PhotoFavouritesWeight and everything else 1.  A weight of 0 leaves
+// the photo out.
+func photoWeight(photo string, config configStruct) int {
+	for p := photo; p != "." && p != "/" && p != ""; p = filepath.ToSlash(filepath.Dir(p)) {
+		if w, ok := config.PhotoWeights[p]; ok {
+			return w
+		}
+	}
+	if config.PhotoFavouritesWeight > 0 {
+		for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(photo)), "/") {
+			if strings.EqualFold(dir, "favourites") || strings.EqualFold(dir, "favorites") {
+				return config.PhotoFavouritesWeight
+			}
+		}
+	}
+	return 1
+}
+
+func loadDeck(path string) photoDeck {
+	var deck photoDeck
+	deckBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+path+"\n")
+		}
+		return deck
+	}
+	if err := json.Unmarshal(deckBytes, &deck); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Error unmarshaling "+path+"\n")
+		return photoDeck{}
+	}
+	return deck
+}
+
+func (d *photoDeck) save(path string) error {
+	deckBytes, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, deckBytes, 0644)
+}
@@ -6,19 +6,17 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	calendar "google.golang.org/api/calendar/v3"
 )
 
 //Define structures to receive weather forecast from JSON
@@ -196,6 +194,7 @@ type entryList struct {
 			} `xml:"sn"`
 			Dt []struct {
 				Text string `xml:",chardata"`
+				Raw  string `xml:",innerxml"`
 				Sx   struct {
 					Text string `xml:",chardata"`
 					Sxn  struct {
@@ -243,26 +242,75 @@ type configStruct struct {
 	Excludes              string
 	WeatherURL            string
 	WeatherReloadInterval int
+	WeatherRefreshAt      string
 	QotdURL               string
 	QotdReloadInterval    int
+	QotdRefreshAt         string
+	QotdFile              string
+	QotdHistoryFile       string
+	QotdRepeatDays        int
 	WotdURL               string
 	WotdReloadInterval    int
+	WotdRefreshAt         string
 	PhotosDir             string
 	CSSDirectory          string
 	PhotoReloadInterval   int
+	PhotoRefreshAt        string
+	PhotoDeckFile         string
+	PhotoWeights          map[string]int
+	PhotoFavouritesWeight int
+	PhotoFit              string
+	DisplayWidth          int
+	DisplayHeight         int
+	PhotoCacheDir         string
+	PhotoCacheInterval    int
+	PhotoCaptions         bool
+	PhotoOnThisDay        bool
+	GazetteerFile         string
+	GazetteerMaxDistance  int
+	UploadPIN             string
+	UploadDir             string
+	MaxUploadMB           int
+	PhotoWatch            bool
+	PhotoPollInterval     int
+	PhotoTransition       string
+	PhotoFadeSeconds      int
+	PhotoKenBurns         bool
+	CalendarRefreshAt     string
+	CalendarInterval      int
+	CalendarCacheFile     string
+	Calendars             []calendarConfig
+	CalendarLayout        string
+	CalendarEvents        int
+	CalendarDays          int
+	ReminderMinutes       int
+	ReminderChime         bool
+	CalendarAddEvents     bool
 	TimeCheckInterval     int
 	HTMLFile              string
+	HTTPAddr              string
+	CalendarAuth          string
 	MWrss                 string
 	MWurl                 string
 	MWkey                 string
+	TranslateLanguage     string
+	Translator            string
+	TranslateDictionary   string
 	MaxPlannerLog         int
 	MaxWeatherLog         int
 	MaxWOTDLog            int
+	MaxQOTDLog            int
 	MaxPhotoLog           int
 } // End of receiving structure for configuration
 
 var forecast darkskyForecast
 
+// Bounds on the wait between failed attempts to load the Word of the Day.
+const (
+	wotdMinBackoff = time.Minute
+	wotdMaxBackoff = time.Hour
+)
+
 func main() {
 	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Starting Planner Application.\n")
 	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Loading Configuration from json/config.json.\n\n")
@@ -270,6 +318,9 @@ func main() {
 	config := getConfig()
 	displayConfig(config)
 
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling startServer()\n")
+	go startServer(config)
+
 	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling startWeather()\n")
 	go startWeather(config)
 	time.Sleep(10 * time.Second)
@@ -278,6 +329,16 @@ func main() {
 	go startWOTD(config)
 	time.Sleep(10 * time.Second)
 
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling startQOTD()\n")
+	go startQOTD(config)
+	time.Sleep(10 * time.Second)
+
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling watchPhotos()\n")
+	go watchPhotos(config)
+
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling startPhotoCache()\n")
+	go startPhotoCache(config)
+
 	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Calling startPhotos()\n")
 	go startPhotos(config)
 	time.Sleep(10 * time.Second)
@@ -288,101 +349,106 @@ func main() {
 }
 
 func startWeather(config configStruct) {
-	// Initial Weather load on startup
-	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Initial Weather() Load\n")
-	getWeather(config)
-
-	// Repeat Weather load every weatherdReloadInterval
-	ticker := time.NewTicker(time.Hour * time.Duration(config.WeatherReloadInterval))
-	for range ticker.C {
-		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Periodic Weather() Load\n")
+	runScheduled("Weather", config.WeatherRefreshAt, time.Hour*time.Duration(config.WeatherReloadInterval), checkInterval(config), func() {
 		getWeather(config)
-	}
-	logger("planner", time.Now().Format(time.RFC850)+"\n  INFO: *** Error: Exit on range ticker in function startWeather(). ***\n\n")
+	})
 }
 
 func startWOTD(config configStruct) {
-	// Initial WOTD load on startup
-	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Initial WOTD() Load\n")
-	getWOTD(config)
-
-	// Repeat WOTD load every wotdReloadInterval
-	ticker := time.NewTicker(time.Hour * time.Duration(config.WotdReloadInterval))
-	for range ticker.C {
-		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Periodic WOTD() Load\n")
-		getWOTD(config)
+	runScheduled("WOTD", config.WotdRefreshAt, time.Hour*time.Duration(config.WotdReloadInterval), checkInterval(config), func() {
+		retryWOTD(config)
+	})
+}
+
+// retryWOTD calls getWOTD until it succeeds, doubling the wait between
+// attempts up to wotdMaxBackoff.  planner.html is only rewritten on success,
+// so the previous word stays on screen while retrying.
+func retryWOTD(config configStruct) {
+	backoff := wotdMinBackoff
+	for {
+		err := getWOTD(config)
+		if err == nil {
+			return
+		}
+		logger("wotd", time.Now().Format(time.RFC850)+"  ERROR: getWOTD() failed: "+err.Error()+"\n")
+		logger("wotd", time.Now().Format(time.RFC850)+"  ERROR: Keeping previous word, retrying in "+backoff.String()+"\n")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > wotdMaxBackoff {
+			backoff = wotdMaxBackoff
+		}
 	}
-	logger("planner", time.Now().Format(time.RFC850)+"\n  INFO: *** Error: Exit on range ticker in function startWOTD(). ***\n\n")
 }
 
 func startPhotos(config configStruct) {
-	// Initial Photos load on startup
-	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Initial Photos() Load\n")
-	getPhotos(config)
-
-	// Repeat WOTD load every wotdReloadInterval
-	ticker := time.NewTicker(time.Minute * time.Duration(config.PhotoReloadInterval))
-	for range ticker.C {
-		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Periodic Photos() Load\n")
+	runScheduled("Photos", config.PhotoRefreshAt, time.Minute*time.Duration(config.PhotoReloadInterval), checkInterval(config), func() {
 		getPhotos(config)
-	}
-	logger("planner", time.Now().Format(time.RFC850)+"\n  INFO: *** Error: Exit on range ticker in function startPhotos(). ***\n\n")
+	})
 }
 
 func startCalendar(config configStruct) {
-	// Initial Calendar load on startup
-	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Initial Calendar() Load\n")
-	getCalendar(config)
-
-	// Repeat Calendar load every 24 hours
-	ticker := time.NewTicker(time.Hour * time.Duration(12))
-	for range ticker.C {
-		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Periodic Calendar() Load\n")
-		getCalendar(config)
+	go watchReminders(config)
+
+	// Calendar reloads every calendarInterval minutes, 12 hours if not set,
+	// unless calendarRefreshAt is set
+	interval := config.CalendarInterval
+	if interval <= 0 {
+		interval = 12 * 60
 	}
-	logger("planner", time.Now().Format(time.RFC850)+"\n  INFO: *** Error: Exit on range ticker in function startCalendar(). ***\n\n")
+	runScheduled("Calendar", config.CalendarRefreshAt, time.Minute*time.Duration(interval), checkInterval(config), func() {
+		getCalendar(config)
+	})
+}
+
+// checkInterval is how often the schedulers compare the wall clock against
+// their next due time.
+func checkInterval(config configStruct) time.Duration {
+	return time.Second * time.Duration(config.TimeCheckInterval)
 }
 
+// getPhotos shows the photos chosen last time, then chooses the next ones
+// and has the page preload them, so the change is smooth when it comes.
 func getPhotos(config configStruct) {
-	cssBytes, err := ioutil.ReadFile(config.CSSDirectory)
-	if err != nil {
-		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+config.CSSDirectory+"\n")
+	fit, chosen := takeUpcoming(config)
+	if len(chosen) == 0 {
+		fit, chosen = pickPhotos(config)
 	}
-	css := string(cssBytes)
-
-	rand.Seed(time.Now().Unix())
-
-	deck, err := ioutil.ReadDir(config.PhotosDir)
-	if err != nil {
-		logger("photo", time.Now().Format(time.RFC850)+"  INFO: ReadDir error on"+config.PhotosDir+"\n")
+	if len(chosen) == 0 {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: No usable photos in "+config.PhotosDir+", using fallback background\n")
+		setBackground("cover", textStyles(config, "cover", nil), "")
+		publish("background", backgroundMessage(config))
+		return
 	}
 
-	index := rand.Intn(len(deck))
-	photo := deck[index].Name()
-
-	startStr := "background: url(../photos/"
-	stopStr := ") no-repeat center center fixed"
-	start := strings.Index(css, startStr)
-	stop := strings.Index(css, stopStr) + len(stopStr)
-	oldStr := css[start:stop]
-	newStr := startStr + photo + stopStr
-	css = strings.Replace(css, oldStr, newStr, 1)
+	var captions []string
+	if config.PhotoCaptions {
+		for _, photo := range chosen {
+			if caption := photoCaption(config, photo); caption != "" {
+				captions = append(captions, caption)
+			}
+		}
+	}
+	setBackground(fit, textStyles(config, fit, chosen), strings.Join(captions, "  |  "), chosen...)
+	publish("background", backgroundMessage(config))
+	logger("photo", time.Now().Format(time.RFC850)+"  INFO: Background is now "+strings.Join(chosen, " and ")+" ("+fit+")\n")
 
-	cssFile := []byte(css)
-	ioutil.WriteFile(config.CSSDirectory, cssFile, 0644)
+	nextFit, next := pickPhotos(config)
+	setUpcoming(config, nextFit, next)
 }
 
 func getWeather(config configStruct) {
+	darkskyURL := config.WeatherURL + config.DarkSkyKey + "/" + config.Latitude + "," + config.Longitude + "?" + config.Excludes
+	forecast = getForecast(darkskyURL)
+	forecast.Daily.Data = forecast.Daily.Data[:3]
+
+	pageLock.Lock()
+	defer pageLock.Unlock()
 	htmlBytes, err := ioutil.ReadFile(config.HTMLFile)
 	if err != nil {
 		logger("weather", time.Now().Format(time.RFC850)+"ReadFile failed w/ err on"+config.HTMLFile+"\n")
 	}
 	html := string(htmlBytes)
 
-	darkskyURL := config.WeatherURL + config.DarkSkyKey + "/" + config.Latitude + "," + config.Longitude + "?" + config.Excludes
-	forecast = getForecast(darkskyURL)
-	forecast.Daily.Data = forecast.Daily.Data[:3]
-
 	startStr := "<span id=\"currentTemp\">"
 	stopStr := " &#8457"
 	valueStr := string(truncate(forecast.Current.Temperature, 0))
@@ -582,92 +648,75 @@ func getWeather(config configStruct) {
 	html = strings.Replace(html, oldStr, newStr, 1)
 
 	htmlFile := []byte(html)
-	ioutil.WriteFile(config.HTMLFile, htmlFile, 0644)
+	if err := ioutil.WriteFile(config.HTMLFile, htmlFile, 0644); err != nil {
+		logger("weather", time.Now().Format(time.RFC850)+"  ERROR: WriteFile failed on "+config.HTMLFile+": "+err.Error()+"\n")
+	}
 
 	logger("weather", time.Now().Format(time.RFC850)+"  INFO: Finished getWeather()\n")
 }
 
 func getCalendar(config configStruct) {
-	var dateStr string
-	var startStr string
-	loop := 0
-
-	b, err := ioutil.ReadFile("client_secret.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+	calendarRefresh.Lock()
+	defer calendarRefresh.Unlock()
+
+	// Each calendar's next events are merged, and the first
+	// config.CalendarEvents shown.  The week view wants every event of the
+	// next seven days instead.
+	now := time.Now()
+	from, to, max := now, now.AddDate(0, 0, calendarDays(config)), calendarEvents(config)
+	if config.CalendarLayout == "week" {
+		from = startOfDay(now)
+		to, max = from.AddDate(0, 0, weekDays), weekMaxEvents
 	}
-
-	// If modifying these scopes, delete your previously saved client_secret.json.
-	oauth2config, err := google.ConfigFromJSON(b, calendar.CalendarReadonlyScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	// A calendar that can't be read keeps showing the events it had, and
+	// the panel says since when it has been unavailable
+	var items []calendarEvent
+	for _, source := range calendarSources(config) {
+		cal := source.Calendar()
+		events, err := source.Events(from, to, max)
+		if err != nil {
+			logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: Unable to retrieve events of "+cal.Name+": "+err.Error()+"\n")
+			events = calendarFailed(cal, err, events, from, to)
+		} else {
+			calendarRead(cal, events)
+		}
+		items = append(items, events...)
 	}
+	items = firstEvents(items, max)
+	setReminderEvents(items)
 
-	srv, err := calendar.New(getClient(oauth2config))
-	if err != nil {
-		log.Fatalf("Unable to retrieve Calendar client: %v", err)
+	logger("calendar", "Upcoming events: "+strconv.Itoa(len(items)))
+	for _, item := range items {
+		logger("calendar", item.Summary+" ("+item.Start.Format("Monday Jan 2 at 3:04pm")+") ["+item.Calendar.Name+"]")
 	}
 
+	pageLock.Lock()
+	defer pageLock.Unlock()
 	htmlBytes, err := ioutil.ReadFile(config.HTMLFile)
 	if err != nil {
-		log.Fatalln("ReadFile failed w/ err", err)
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+config.HTMLFile+": "+err.Error()+"\n")
+		return
 	}
-	html := string(htmlBytes)
-
-	//layout := "2006-01-02T15:04:05Z"
-	t := time.Now().Format(time.RFC3339)
-	events, err := srv.Events.List("primary").ShowDeleted(false).
-		SingleEvents(true).TimeMin(t).MaxResults(10).OrderBy("startTime").Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve next ten of the user's events: %v", err)
-	}
-	logger("calendar", "Upcoming events:")
-	if len(events.Items) == 0 {
-		logger("calendar", "No upcoming events found.")
+	page := string(htmlBytes)
+	if config.CalendarLayout == "week" {
+		page = replaceMarked(page, "<ul id=\"eventList\">", "<!-- events --></ul>", "")
+		page = replaceMarked(page, "<div id=\"calendarWeek\">", "<!-- week --></div>", weekGrid(items, from, now))
 	} else {
-		for _, item := range events.Items {
-			date := item.Start.DateTime
-			if date == "" {
-				date = item.Start.Date
-			}
-			loop++
-			splitstr := strings.Split(date, "T")
-			if len(splitstr) == 1 {
-				datefmt := "2006-01-02"
-				tm, err := time.Parse(datefmt, splitstr[0])
-				if err != nil {
-					errmsg := fmt.Sprintf("Error in time.Parse(): %s", err)
-					logger("calendar", errmsg)
-				}
-				dateStr = tm.Format("Mon Jan 2")
-			}
-
-			if len(splitstr) == 2 {
-				dtStr := splitstr[0] + " " + splitstr[1]
-				dtStr = dtStr[:16]
-				datefmt := "2006-01-02 15:04"
-				tm, err := time.Parse(datefmt, dtStr)
-				if err != nil {
-					errmsg := fmt.Sprintf("Error in time.Parse(): %s", err)
-					logger("calendar", errmsg)
-				}
-				dateStr = tm.Format("Monday Jan 2 at 3:04pm")
-			}
-
-			logger("calendar", item.Summary+" ("+dateStr+")")
-			startStr = "<li id=\"item" + strconv.Itoa(loop) + "\">"
-			stopStr := "<!-- e" + strconv.Itoa(loop) + " --></li>"
-			valueStr := item.Summary + " (" + dateStr + ")"
-			start := strings.Index(html, startStr)
-			stop := strings.Index(html, stopStr) + len(stopStr)
-			oldStr := html[start:stop]
-			newStr := startStr + valueStr + stopStr
-			html = strings.Replace(html, oldStr, newStr, 1)
-
-		}
-		htmlFile := []byte(html)
-		ioutil.WriteFile(config.HTMLFile, htmlFile, 0644)
+		page = replaceMarked(page, "<ul id=\"eventList\">", "<!-- events --></ul>", eventList(items, calendarDays(config), now))
+		page = replaceMarked(page, "<div id=\"calendarWeek\">", "<!-- week --></div>", "")
+	}
+	page = replaceMarked(page, "<p id=\"calendarLegend\">", "<!-- legend --></p>", calendarLegend(config))
+	page = replaceMarked(page, "<p id=\"nextEvent\">", "<!-- next --></p>", nextEvent(items, now))
+	page = replaceMarked(page, "<p id=\"calendarStatus\">", "<!-- status --></p>", calendarStatus(now))
+	addLink := ""
+	if config.CalendarAddEvents && config.UploadPIN != "" {
+		addLink = "<a href=\"/add\">+ Add event</a>"
 	}
+	page = replaceMarked(page, "<p id=\"addEvent\">", "<!-- add --></p>", addLink)
+	if err := ioutil.WriteFile(config.HTMLFile, []byte(page), 0644); err != nil {
+		logger("calendar", time.Now().Format(time.RFC850)+"  ERROR: WriteFile failed on "+config.HTMLFile+": "+err.Error()+"\n")
+	}
+	scheduleCalendarRetry(config)
 }
 
 func getConfig() configStruct {
@@ -695,28 +744,81 @@ func displayConfig(config configStruct) {
 
 	logger("planner", "           weatherURL: "+config.WeatherURL+"\n")
 	logger("planner", "weatherReloadInterval: "+strconv.Itoa(config.WeatherReloadInterval)+" Hr.\n")
+	logger("planner", "     weatherRefreshAt: "+config.WeatherRefreshAt+"\n")
 
 	logger("planner", "              qotdURL: "+config.QotdURL+"\n")
 	logger("planner", "   qotdReloadInterval: "+strconv.Itoa(config.QotdReloadInterval)+" Hr.\n")
+	logger("planner", "        qotdRefreshAt: "+config.QotdRefreshAt+"\n")
+	logger("planner", "             qotdFile: "+config.QotdFile+"\n")
+	logger("planner", "      qotdHistoryFile: "+config.QotdHistoryFile+"\n")
+	logger("planner", "       qotdRepeatDays: "+strconv.Itoa(config.QotdRepeatDays)+" Days\n")
 
 	logger("planner", "              wotdURL: "+config.WotdURL+"\n")
 	logger("planner", "   wotdReloadInterval: "+strconv.Itoa(config.WotdReloadInterval)+" Hr.\n")
+	logger("planner", "        wotdRefreshAt: "+config.WotdRefreshAt+"\n")
 
 	logger("planner", "            photosDir: "+config.PhotosDir+"\n")
 	logger("planner", "         cssDirectory: "+config.CSSDirectory+"\n")
 	logger("planner", "  photoReloadInterval: "+strconv.Itoa(config.PhotoReloadInterval)+" Min.\n")
+	logger("planner", "       photoRefreshAt: "+config.PhotoRefreshAt+"\n")
+	logger("planner", "        photoDeckFile: "+config.PhotoDeckFile+"\n")
+	logger("planner", "         photoWeights: "+fmt.Sprint(config.PhotoWeights)+"\n")
+	logger("planner", "photoFavouritesWeight: "+strconv.Itoa(config.PhotoFavouritesWeight)+"\n")
+	logger("planner", "             photoFit: "+config.PhotoFit+"\n")
+	logger("planner", "         displayWidth: "+strconv.Itoa(config.DisplayWidth)+" px.\n")
+	logger("planner", "        displayHeight: "+strconv.Itoa(config.DisplayHeight)+" px.\n")
+	logger("planner", "        photoCacheDir: "+config.PhotoCacheDir+"\n")
+	logger("planner", "   photoCacheInterval: "+strconv.Itoa(config.PhotoCacheInterval)+" Min.\n")
+	logger("planner", "        photoCaptions: "+strconv.FormatBool(config.PhotoCaptions)+"\n")
+	logger("planner", "       photoOnThisDay: "+strconv.FormatBool(config.PhotoOnThisDay)+"\n")
+	logger("planner", "        gazetteerFile: "+config.GazetteerFile+"\n")
+	logger("planner", " gazetteerMaxDistance: "+strconv.Itoa(config.GazetteerMaxDistance)+" km.\n")
+	if config.UploadPIN != "" {
+		logger("planner", "            uploadPIN: (set)\n")
+	} else {
+		logger("planner", "            uploadPIN: \n")
+	}
+	logger("planner", "            uploadDir: "+config.UploadDir+"\n")
+	logger("planner", "          maxUploadMB: "+strconv.Itoa(config.MaxUploadMB)+" MB.\n")
+	logger("planner", "           photoWatch: "+strconv.FormatBool(config.PhotoWatch)+"\n")
+	logger("planner", "    photoPollInterval: "+strconv.Itoa(config.PhotoPollInterval)+" Sec.\n")
+	logger("planner", "      photoTransition: "+config.PhotoTransition+"\n")
+	logger("planner", "     photoFadeSeconds: "+strconv.Itoa(config.PhotoFadeSeconds)+" Sec.\n")
+	logger("planner", "        photoKenBurns: "+strconv.FormatBool(config.PhotoKenBurns)+"\n")
+	logger("planner", "    calendarRefreshAt: "+config.CalendarRefreshAt+"\n")
+	logger("planner", "     calendarInterval: "+strconv.Itoa(config.CalendarInterval)+" Min.\n")
+	logger("planner", "    calendarCacheFile: "+config.CalendarCacheFile+"\n")
+	for _, cal := range calendarsToShow(config) {
+		source := cal.ID
+		if cal.URL != "" {
+			source = cal.Type + " " + cal.URL
+		}
+		logger("planner", "             calendar: "+cal.Name+" ("+source+", "+cal.Colour+", reminders "+reminderMinutesList(cal.Reminders)+")\n")
+	}
+	logger("planner", "       calendarLayout: "+config.CalendarLayout+"\n")
+	logger("planner", "       calendarEvents: "+strconv.Itoa(config.CalendarEvents)+"\n")
+	logger("planner", "         calendarDays: "+strconv.Itoa(config.CalendarDays)+" Days\n")
+	logger("planner", "      reminderMinutes: "+strconv.Itoa(config.ReminderMinutes)+" Min.\n")
+	logger("planner", "        reminderChime: "+strconv.FormatBool(config.ReminderChime)+"\n")
+	logger("planner", "    calendarAddEvents: "+strconv.FormatBool(config.CalendarAddEvents)+"\n")
 
 	logger("planner", "    timeCheckInterval: "+strconv.Itoa(config.TimeCheckInterval)+" Sec.\n")
 
 	logger("planner", "             HTMLFile: "+config.HTMLFile+"\n")
+	logger("planner", "             HTTPAddr: "+config.HTTPAddr+"\n")
+	logger("planner", "         calendarAuth: "+config.CalendarAuth+"\n")
 
 	logger("planner", "                mwRSS: "+config.MWrss+"\n")
 	logger("planner", "                mwURL: "+config.MWurl+"\n")
 	logger("planner", "                mwKEY: "+config.MWkey+"\n")
+	logger("planner", "    translateLanguage: "+config.TranslateLanguage+"\n")
+	logger("planner", "           translator: "+config.Translator+"\n")
+	logger("planner", "  translateDictionary: "+config.TranslateDictionary+"\n")
 
 	logger("planner", "        maxPlannerLog: "+strconv.Itoa(config.MaxPlannerLog)+" M.\n")
 	logger("planner", "        maxWeatherLog: "+strconv.Itoa(config.MaxWeatherLog)+" M.\n")
 	logger("planner", "           maxWOTDLog: "+strconv.Itoa(config.MaxWOTDLog)+" M.\n")
+	logger("planner", "           maxQOTDLog: "+strconv.Itoa(config.MaxQOTDLog)+" M.\n")
 	logger("planner", "          maxPhotoLog: "+strconv.Itoa(config.MaxPhotoLog)+" M.\n\n")
 }
 
@@ -791,32 +893,42 @@ func getForecast(darkskyURL string) darkskyForecast {
 	return forecast
 }
 
-func getWOTD(config configStruct) {
+func getWOTD(config configStruct) error {
+	client := http.Client{Timeout: 30 * time.Second}
+
 	rssURL := config.MWrss
-	data, err := http.Get(rssURL)
+	data, err := client.Get(rssURL)
 	if err != nil {
-		logger("wotd", time.Now().Format(time.RFC850)+"  INFO: Error on http.Get(rssURL):\n")
+		return fmt.Errorf("http.Get(rssURL): %v", err)
 	}
 	dataBYTES, err := ioutil.ReadAll(data.Body)
+	data.Body.Close()
 	if err != nil {
-		logger("wotd", time.Now().Format(time.RFC850)+"  INFO: Error on ioutil.ReadAll(data.Body):")
+		return fmt.Errorf("ioutil.ReadAll(rss body): %v", err)
+	}
+	if data.StatusCode != http.StatusOK {
+		return fmt.Errorf("http.Get(rssURL): %s", data.Status)
 	}
-	data.Body.Close()
 	rss := string(dataBYTES)
 
 	word := extract(rss, "<![CDATA[", "]]>")
+	if word == "NotFound" || word == "" {
+		return fmt.Errorf("no word found in %s", rssURL)
+	}
 	wotdURL := config.MWurl + word + "?key=" + config.MWkey
-	data, err = http.Get(wotdURL)
+	data, err = client.Get(wotdURL)
 	if err != nil {
-		logger("wotd", time.Now().Format(time.RFC850)+"  INFO: Error on http.Get(wotdURL)")
+		return fmt.Errorf("http.Get(wotdURL): %v", err)
 	}
 	dataBYTES, err = ioutil.ReadAll(data.Body)
+	data.Body.Close()
 	if err != nil {
-		logger("wotd", time.Now().Format(time.RFC850)+"  INFO: Error on ioutil.ReadAll(data.Body):")
+		return fmt.Errorf("ioutil.ReadAll(dictionary body): %v", err)
+	}
+	if data.StatusCode != http.StatusOK {
+		return fmt.Errorf("http.Get(wotdURL): %s", data.Status)
 	}
 	logger("wotd", time.Now().Format(time.RFC850)+"  dataBYTES ="+string(dataBYTES))
-	data.Body.Close()
-	logger("wotd", string(dataBYTES))
 
 	//  For XML test only
 	//d1 := dataBYTES
@@ -825,14 +937,15 @@ func getWOTD(config configStruct) {
 	var def1 entryList
 	err = xml.Unmarshal(dataBYTES, &def1)
 	if err != nil {
-		errmsg := fmt.Sprintf(time.Now().Format(time.RFC850)+"  INFO: Error on xml.Unmarshall(dataBytes): %s", err)
-		logger("wotd", errmsg)
+		return fmt.Errorf("xml.Unmarshal(dataBYTES): %v", err)
+	}
+	if def1.Entry.ID == "" {
+		return fmt.Errorf("no dictionary entry for %q", word)
 	}
 	result := fmt.Sprintf("%+v\n", def1)
 	logger("wotd", result)
 
 	var wotdInfo wotdType
-	logger("wotd", "XML = "+string(dataBYTES))
 	wotdInfo.Word = def1.Entry.ID
 	logger("wotd", time.Now().Format(time.RFC850)+"  Word: "+wotdInfo.Word+"\n")
 	wotdInfo.Pronounce = def1.Entry.Pr.Text
@@ -845,65 +958,43 @@ func getWOTD(config configStruct) {
 
 	for x < numdefs {
 		if len(def1.Entry.Def.Dt[x].Text) > 0 {
-			wotdInfo.Defs = append(wotdInfo.Defs, string(def1.Entry.Def.Dt[x].Text))
-			logger("wotd", time.Now().Format(time.RFC850)+string(def1.Entry.Def.Dt[x].Text))
+			wotdInfo.Defs = append(wotdInfo.Defs, def1.Entry.Def.Dt[x].Raw)
+			logger("wotd", time.Now().Format(time.RFC850)+def1.Entry.Def.Dt[x].Raw)
 		}
 		x++
 	}
 
-	htmlBytes, err := ioutil.ReadFile("planner.html")
+	translatedWord, translatedDef := translateWOTD(config, wotdInfo)
+
+	pageLock.Lock()
+	defer pageLock.Unlock()
+	htmlBytes, err := ioutil.ReadFile(config.HTMLFile)
 	if err != nil {
-		log.Fatalln("ReadFile failed w/ err", err)
+		return fmt.Errorf("ReadFile failed on %s: %v", config.HTMLFile, err)
 	}
-	html := string(htmlBytes)
-
-	startStr := "<span id=\"word\">"
-	stopStr := ":&nbsp;<!--w1--></span>"
-	valueStr := string(wotdInfo.Word)
-	start := strings.Index(html, startStr)
-	stop := strings.Index(html, stopStr) + len(stopStr)
-	oldStr := html[start:stop]
-	newStr := startStr + valueStr + stopStr
-	html = strings.Replace(html, oldStr, newStr, 1)
+	page := string(htmlBytes)
 
-	startStr = "<span id=\"pronounce\">[&nbsp;"
-	stopStr = "&nbsp;]<!--w2--></span>"
-	valueStr = "&nbsp;" + string(wotdInfo.Pronounce)
-	start = strings.Index(html, startStr)
-	stop = strings.Index(html, stopStr) + len(stopStr)
-	oldStr = html[start:stop]
-	newStr = startStr + valueStr + stopStr
-	html = strings.Replace(html, oldStr, newStr, 1)
+	page = replaceMarked(page, "<span id=\"word\">", ":&nbsp;<!--w1--></span>", html.EscapeString(wotdInfo.Word))
+	page = replaceMarked(page, "<span id=\"pronounce\">[&nbsp;", "&nbsp;]<!--w2--></span>", "&nbsp;"+html.EscapeString(wotdInfo.Pronounce))
+	page = replaceMarked(page, "<span id=\"pos\">", "<!--w3--></span>", "&nbsp;"+html.EscapeString(wotdInfo.POS))
 
-	startStr = "<span id=\"pos\">"
-	stopStr = "<!--w3--></span>"
-	valueStr = "&nbsp;" + string(wotdInfo.POS)
-	start = strings.Index(html, startStr)
-	stop = strings.Index(html, stopStr) + len(stopStr)
-	oldStr = html[start:stop]
-	newStr = startStr + valueStr + stopStr
-	html = strings.Replace(html, oldStr, newStr, 1)
-
-	valueStr = ""
-	d := 0
-	for d < len(wotdInfo.Defs) {
-		startStr = "<span id=\"defs\">"
-		stopStr = "<!--w4--></span>"
-		cleanerdef := erase(string(wotdInfo.Defs[d]), ":")
+	valueStr := ""
+	for d, def := range wotdInfo.Defs {
+		cleanerdef := formatDefinition(def)
 		valueStr = valueStr + "&nbsp;&nbsp;&nbsp;Definition " + strconv.Itoa(d+1) + ") &nbsp;" + cleanerdef + "<br>"
-		start = strings.Index(html, startStr)
-		stop = strings.Index(html, stopStr) + len(stopStr)
-		oldStr = html[start:stop]
-		d++
 	}
+	page = replaceMarked(page, "<span id=\"defs\">", "<!--w4--></span>", valueStr)
 
-	newStr = startStr + valueStr + stopStr
-	html = strings.Replace(html, oldStr, newStr, 1)
+	page = replaceMarked(page, "<span id=\"translation\">", "<!--t1--></span>", translatedWord)
+	page = replaceMarked(page, "<span id=\"translationDef\">", "<!--t2--></span>", translatedDef)
 
-	htmlFile := []byte(html)
-	ioutil.WriteFile("planner.html", htmlFile, 0644)
+	err = ioutil.WriteFile(config.HTMLFile, []byte(page), 0644)
+	if err != nil {
+		return fmt.Errorf("WriteFile failed on %s: %v", config.HTMLFile, err)
+	}
 
 	logger("wotd", time.Now().Format(time.RFC850)+"  INFO: Finished getWOTD()\n")
+	return nil
 }
 
 func truncate(x interface{}, p int) string {
@@ -927,32 +1018,41 @@ func getTime(reportedStr string) time.Time {
 }
 
 func extract(src string, startStr string, stopStr string) string {
-	start := strings.Index(src, startStr) + len(startStr)
+	start := strings.Index(src, startStr)
 	if start == -1 {
 		return "NotFound"
 	}
+	start += len(startStr)
 
-	stop := strings.Index(src, stopStr)
+	stop := strings.Index(src[start:], stopStr)
 	if stop == -1 {
 		return "NotFound"
 	}
+	stop += start
 
 	found := src[start:stop]
 	return found
 }
 
-func erase(src string, ch string) string {
-	if len(ch) > 1 || len(ch) == 0 {
-		return "erase() failed on ch"
+// pageLock is held while config.HTMLFile is read, changed and written
+// back.  The updaters each run on a schedule of their own, and would
+// otherwise undo each other's changes.
+var pageLock sync.Mutex
+
+// replaceMarked replaces everything between startStr and stopStr in src with
+// value, leaving both markers in place.  src is returned unchanged if either
+// marker is missing.
+func replaceMarked(src string, startStr string, stopStr string, value string) string {
+	start := strings.Index(src, startStr)
+	if start == -1 {
+		return src
 	}
-	p := 0
-	for p < len(src) {
-		if string(src[p]) == ch {
-			src = src[:p] + src[p+1:]
-		}
-		p++
+	stop := strings.Index(src[start:], stopStr)
+	if stop == -1 {
+		return src
 	}
-	return src
+	stop += start + len(stopStr)
+	return src[:start] + startStr + value + stopStr + src[stop:]
 }
 
 func logger(logname string, message string) {
@@ -1007,53 +1107,39 @@ func copyFile(src, dest string) (err error) {
 	return nil
 }
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+// Retrieve the saved token and return a client using it.  Without one, a
+// sign-in is started with startCalendarAuth and errNeedsAuth returned; the
+// token is saved when the sign-in completes.
+func getClient(config configStruct, oauthConfig *oauth2.Config) (*http.Client, error) {
+	tok, err := tokenFromFile(tokenFile)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		startCalendarAuth(config, oauthConfig)
+		return nil, errNeedsAuth
 	}
-	return config.Client(context.Background(), tok)
-}
-
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	log.Fatalf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
-	}
-
-	tok, err := config.Exchange(oauth2.NoContext, authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
-	}
-	return tok
+	return oauthConfig.Client(context.Background(), tok), nil
 }
 
 // Retrieves a token from a local file.
 func tokenFromFile(file string) (*oauth2.Token, error) {
 	f, err := os.Open(file)
-	defer f.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	tok := &oauth2.Token{}
 	err = json.NewDecoder(f).Decode(tok)
 	return tok, err
 }
 
 // Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
+func saveToken(path string, token *oauth2.Token) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	defer f.Close()
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
+	}
+	err = json.NewEncoder(f).Encode(token)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	json.NewEncoder(f).Encode(token)
+	return err
 }
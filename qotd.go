@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// quote is a single Quote of the Day, whether it came from the feed or from
+// the local file of curated quotes.
+type quote struct {
+	Text   string `json:"text"`
+	Author string `json:"author"`
+}
+
+// Define structures to receive QOTD from an RSS 2.0 or Atom feed
+type qotdFeed struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Description string `xml:"description"`
+			Author      string `xml:"author"`
+			Creator     string `xml:"creator"`
+		} `xml:"item"`
+	} `xml:"channel"`
+	Entries []struct {
+		Title   string `xml:"title"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+		Author  struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+	} `xml:"entry"`
+} // End of receiving structure for QOTD feed
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func startQOTD(config configStruct) {
+	runScheduled("QOTD", config.QotdRefreshAt, time.Hour*time.Duration(config.QotdReloadInterval), checkInterval(config), func() {
+		getQOTD(config)
+	})
+}
+
+func getQOTD(config configStruct) {
+	var candidates []quote
+
+	feedQuotes, err := getQuoteFeed(config.QotdURL)
+	if err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: "+err.Error()+"\n")
+	}
+	candidates = append(candidates, feedQuotes...)
+
+	localQuotes, err := getQuoteFile(config.QotdFile)
+	if err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: "+err.Error()+"\n")
+	}
+	rand.Shuffle(len(localQuotes), func(i, j int) {
+		localQuotes[i], localQuotes[j] = localQuotes[j], localQuotes[i]
+	})
+	candidates = append(candidates, localQuotes...)
+
+	if len(candidates) == 0 {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: No quotes available from feed or "+config.QotdFile+"\n")
+		return
+	}
+
+	history := loadQuoteHistory(config.QotdHistoryFile)
+	q := pickQuote(candidates, history, config.QotdRepeatDays, time.Now())
+	history[quoteKey(q)] = time.Now().Format("2006-01-02")
+	if err := saveQuoteHistory(config.QotdHistoryFile, history); err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: "+err.Error()+"\n")
+	}
+	logger("qotd", time.Now().Format(time.RFC850)+"  Quote: "+q.Text+" -- "+q.Author+"\n")
+
+	pageLock.Lock()
+	defer pageLock.Unlock()
+	htmlBytes, err := ioutil.ReadFile(config.HTMLFile)
+	if err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+config.HTMLFile+"\n")
+		return
+	}
+	page := string(htmlBytes)
+
+	page = replaceMarked(page, "<span id=\"quote\">", "<!--q1--></span>", html.EscapeString(q.Text))
+	author := ""
+	if q.Author != "" {
+		author = "&mdash;&nbsp;" + html.EscapeString(q.Author)
+	}
+	page = replaceMarked(page, "<span id=\"quoteAuthor\">", "<!--q2--></span>", author)
+
+	if err := ioutil.WriteFile(config.HTMLFile, []byte(page), 0644); err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: WriteFile failed on "+config.HTMLFile+": "+err.Error()+"\n")
+		return
+	}
+
+	logger("qotd", time.Now().Format(time.RFC850)+"  INFO: Finished getQOTD()\n")
+}
+
+// getQuoteFeed fetches an RSS 2.0 or Atom feed and returns its entries as
+// quotes.  An item's description (or an entry's content) is taken as the
+// quote text and its title or author as the attribution.
+func getQuoteFeed(feedURL string) ([]quote, error) {
+	if feedURL == "" {
+		return nil, nil
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	data, err := client.Get(feedURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", feedURL, err)
+	}
+	defer data.Body.Close()
+	if data.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", feedURL, data.Status)
+	}
+
+	dataBYTES, err := ioutil.ReadAll(data.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", feedURL, err)
+	}
+
+	var feed qotdFeed
+	if err := xml.Unmarshal(dataBYTES, &feed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", feedURL, err)
+	}
+
+	var quotes []quote
+	for _, item := range feed.Channel.Items {
+		author := item.Author
+		if author == "" {
+			author = item.Creator
+		}
+		if author == "" {
+			author = item.Title
+		}
+		text := item.Description
+		if text == "" {
+			text = item.Title
+		}
+		quotes = appendQuote(quotes, text, author)
+	}
+	for _, entry := range feed.Entries {
+		author := entry.Author.Name
+		if author == "" {
+			author = entry.Title
+		}
+		text := entry.Content
+		if text == "" {
+			text = entry.Summary
+		}
+		quotes = appendQuote(quotes, text, author)
+	}
+	return quotes, nil
+}
+
+// getQuoteFile reads the local file of curated quotes used when the feed is
+// unavailable or every feed quote has been shown recently.
+func getQuoteFile(path string) ([]quote, error) {
+	if path == "" {
+		return nil, nil
+	}
+	quoteBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	var quotes []quote
+	if err := json.Unmarshal(quoteBytes, &quotes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return quotes, nil
+}
+
+// appendQuote cleans feed markup out of text and author and appends the
+// result to quotes, skipping empty entries.
+func appendQuote(quotes []quote, text string, author string) []quote {
+	text = cleanQuoteText(text)
+	author = cleanQuoteText(author)
+	if text == "" || text == author {
+		return quotes
+	}
+	return append(quotes, quote{Text: text, Author: author})
+}
+
+func cleanQuoteText(s string) string {
+	s = tagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.Trim(s, "\"“”")
+}
+
+// quoteKey normalises a quote's text so that the same quote from the feed and
+// from the local file is recognised as one.
+func quoteKey(q quote) string {
+	return strings.ToLower(strings.Join(strings.Fields(q.Text), " "))
+}
+
+// pickQuote returns the first candidate that has not been shown within the
+// last repeatDays days.  If every candidate is that recent, the one shown
+// longest ago is used instead.
+func pickQuote(candidates []quote, history map[string]string, repeatDays int, now time.Time) quote {
+	cutoff := now.AddDate(0, 0, -repeatDays).Format("2006-01-02")
+	oldest := candidates[0]
+	oldestDate := history[quoteKey(oldest)]
+	for _, q := range candidates {
+		shown, ok := history[quoteKey(q)]
+		if !ok || shown <= cutoff {
+			return q
+		}
+		if shown < oldestDate {
+			oldest, oldestDate = q, shown
+		}
+	}
+	return oldest
+}
+
+// loadQuoteHistory returns the date each quote was last shown, keyed by
+// quoteKey.  A missing or unreadable history file yields an empty history.
+func loadQuoteHistory(path string) map[string]string {
+	history := make(map[string]string)
+	historyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: ReadFile failed on "+path+"\n")
+		}
+		return history
+	}
+	if err := json.Unmarshal(historyBytes, &history); err != nil {
+		logger("qotd", time.Now().Format(time.RFC850)+"  ERROR: Error unmarshaling "+path+"\n")
+	}
+	return history
+}
+
+func saveQuoteHistory(path string, history map[string]string) error {
+	historyBytes, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, historyBytes, 0644)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reminderLinger is how long after an event has started its reminder is
+// still shown, unless someone dismisses it.
+const reminderLinger = 5 * time.Minute
+
+// reminder is a banner shown on the planner's screen ahead of an event.
+// Offset is how many minutes ahead of the event it is due, as an event
+// can have several reminders.
+type reminder struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary"`
+	When    string `json:"when"`
+	Start   int64  `json:"start"`
+	Offset  int    `json:"offset"`
+	Colour  string `json:"colour"`
+}
+
+// reminderMessage is the "reminders" event sent to the page: every
+// reminder showing, and whether new ones should chime.
+type reminderMessage struct {
+	Reminders []reminder `json:"reminders"`
+	Chime     bool       `json:"chime"`
+}
+
+// reminders holds the events watched for reminders, as last fetched by
+// getCalendar, the reminders already given, so each is only given once,
+// and those showing now.
+var reminders struct {
+	sync.Mutex
+	events []calendarEvent
+	given  map[string]time.Time
+	active map[string]reminder
+}
+
+// setReminderEvents replaces the events watched for reminders.
+func setReminderEvents(events []calendarEvent) {
+	reminders.Lock()
+	reminders.events = append([]calendarEvent(nil), events...)
+	reminders.Unlock()
+}
+
+// reminderOffsets is how long before an event its reminders are due.  The
+// event's own reminders, such as Google Calendar popups or ICS alarms, are
+// used unless its calendar ignores them, along with the calendar's
+// reminders or, failing those, config.ReminderMinutes.  The minutes are
+// only applied to events with a start time.
+func reminderOffsets(config configStruct, e calendarEvent) []time.Duration {
+	var offsets []time.Duration
+	if !e.Calendar.IgnoreOwnReminders {
+		offsets = append(offsets, e.Reminders...)
+	}
+	minutes := e.Calendar.Reminders
+	if minutes == nil && config.ReminderMinutes > 0 {
+		minutes = []int{config.ReminderMinutes}
+	}
+	if !e.AllDay {
+		for _, m := range minutes {
+			offsets = append(offsets, time.Duration(m)*time.Minute)
+		}
+	}
+	return offsets
+}
+
+// watchReminders puts up reminders as they come due.
+func watchReminders(config configStruct) {
+	check := checkInterval(config)
+	if check <= 0 {
+		check = 15 * time.Second
+	}
+	for now := range time.Tick(check) {
+		checkReminders(config, now)
+	}
+}
+
+func checkReminders(config configStruct, now time.Time) {
+	reminders.Lock()
+	defer reminders.Unlock()
+	if reminders.given == nil {
+		reminders.given = make(map[string]time.Time)
+		reminders.active = make(map[string]reminder)
+	}
+
+	changed, added := false, false
+	for _, e := range reminders.events {
+		if !now.Before(e.Start.Add(reminderLinger)) {
+			continue
+		}
+		for _, offset := range reminderOffsets(config, e) {
+			key := e.ID + "/" + offset.String()
+			if now.Before(e.Start.Add(-offset)) {
+				continue
+			}
+			if _, ok := reminders.given[key]; ok {
+				continue
+			}
+			reminders.given[key] = e.Start
+			// A later reminder of an event already showing replaces the
+			// earlier one, so it chimes again
+			if r, ok := reminders.active[e.ID]; ok && r.Offset <= int(offset/time.Minute) {
+				continue
+			}
+			when := "at " + e.Start.Format("3:04pm")
+			if e.AllDay {
+				when = "all day"
+			}
+			reminders.active[e.ID] = reminder{ID: e.ID, Summary: e.Summary, When: dayHeading(e.Start, now) + " " + when,
+				Start: e.Start.Unix() * 1000, Offset: int(offset / time.Minute), Colour: e.Calendar.Colour}
+			logger("calendar", time.Now().Format(time.RFC850)+"  INFO: Reminder: "+e.Summary+" "+when+"\n")
+			changed, added = true, true
+		}
+	}
+
+	for id, r := range reminders.active {
+		if !now.Before(time.Unix(0, r.Start*int64(time.Millisecond)).Add(reminderLinger)) {
+			delete(reminders.active, id)
+			changed = true
+		}
+	}
+	for key, start := range reminders.given {
+		if now.After(start.Add(reminderLinger)) {
+			delete(reminders.given, key)
+		}
+	}
+	if changed {
+		publishReminders(added && config.ReminderChime)
+	}
+}
+
+// publishReminders sends the page the reminders showing.  reminders must
+// be locked.  Pages connecting later are sent them without the chime, as
+// they were news only when they were given.
+func publishReminders(chime bool) {
+	msg := reminderMessage{Reminders: []reminder{}, Chime: chime}
+	for _, r := range reminders.active {
+		msg.Reminders = append(msg.Reminders, r)
+	}
+	sort.Slice(msg.Reminders, func(i, j int) bool {
+		return msg.Reminders[i].Start < msg.Reminders[j].Start
+	})
+	stored := msg
+	stored.Chime = false
+	keepSticky("reminders", stored)
+	publish("reminders", msg)
+}
+
+// handleReminders adds /reminders/dismiss, which the page posts to when a
+// reminder is tapped, to mux.
+func handleReminders(mux *http.ServeMux) {
+	mux.HandleFunc("/reminders/dismiss", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.FormValue("id")
+		reminders.Lock()
+		if _, ok := reminders.active[id]; ok {
+			delete(reminders.active, id)
+			publishReminders(false)
+		}
+		reminders.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// reminderMinutesList is how config.Calendars' reminders are shown by
+// displayConfig.
+func reminderMinutesList(minutes []int) string {
+	if minutes == nil {
+		return "default"
+	}
+	list := ""
+	for i, m := range minutes {
+		if i > 0 {
+			list += ","
+		}
+		list += strconv.Itoa(m)
+	}
+	return "[" + list + "] Min."
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultScheduleInterval is how often an updater runs when it has neither
+// refresh times nor an interval, rather than on every check.
+const defaultScheduleInterval = 24 * time.Hour
+
+// schedule decides when an updater next runs: at fixed local times of day
+// when refreshAt is set, otherwise every interval.
+type schedule struct {
+	times    []time.Duration // offsets from local midnight, ascending
+	interval time.Duration
+}
+
+// newSchedule parses refreshAt, a comma separated list of 24-hour "HH:MM"
+// local times such as "00:05" or "06:00,18:00".  An empty refreshAt gives a
+// plain interval schedule.  The schedule returned with an error is still
+// usable: every interval, or every defaultScheduleInterval without one.
+func newSchedule(refreshAt string, interval time.Duration) (schedule, error) {
+	noInterval := interval <= 0
+	if noInterval {
+		interval = defaultScheduleInterval
+	}
+	s := schedule{interval: interval}
+	for _, field := range strings.Split(refreshAt, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		t, err := time.Parse("15:04", field)
+		if err != nil {
+			return schedule{interval: interval}, fmt.Errorf("bad refresh time %q, want HH:MM", field)
+		}
+		s.times = append(s.times, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	sort.Slice(s.times, func(i, j int) bool { return s.times[i] < s.times[j] })
+	if len(s.times) == 0 && noInterval {
+		return s, fmt.Errorf("no refresh time or interval set")
+	}
+	return s, nil
+}
+
+// next returns the first scheduled run strictly after the wall-clock time
+// last.  Times of day are built with time.Date so daylight saving changes
+// land on the intended local time.
+func (s schedule) next(last time.Time) time.Time {
+	last = last.Round(0)
+	if len(s.times) == 0 {
+		return last.Add(s.interval)
+	}
+	y, m, d := last.Date()
+	for day := 0; day <= 1; day++ {
+		for _, offset := range s.times {
+			h, min := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+			t := time.Date(y, m, d+day, h, min, 0, 0, last.Location())
+			if t.After(last) {
+				return t
+			}
+		}
+	}
+	return last.Add(24 * time.Hour)
+}
+
+func (s schedule) String() string {
+	if len(s.times) == 0 {
+		return "every " + s.interval.String()
+	}
+	var at []string
+	for _, offset := range s.times {
+		at = append(at, fmt.Sprintf("%02d:%02d", int(offset/time.Hour), int(offset%time.Hour/time.Minute)))
+	}
+	return "at " + strings.Join(at, ", ")
+}
+
+// runScheduled runs job once on startup and then whenever sched says it is
+// due.  The wall clock is checked every check rather than sleeping until the
+// due time, so a run missed while the Pi was suspended, or skipped over by a
+// clock change, is noticed and made up on the next check.
+func runScheduled(name string, refreshAt string, interval time.Duration, check time.Duration, job func()) {
+	sched, err := newSchedule(refreshAt, interval)
+	if err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: "+name+"(): "+err.Error()+", running "+sched.String()+"\n")
+	}
+	if check <= 0 {
+		check = time.Minute
+	}
+
+	// Initial load on startup
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Initial "+name+"() Load\n")
+	job()
+	last := time.Now().Round(0)
+	due := sched.next(last)
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: "+name+"() scheduled "+sched.String()+", next at "+due.Format(time.RFC850)+"\n")
+
+	// Repeat load whenever the schedule is due
+	ticker := time.NewTicker(check)
+	for range ticker.C {
+		now := time.Now().Round(0)
+		if now.Before(last) {
+			logger("planner", time.Now().Format(time.RFC850)+"  INFO: Clock moved backwards, rescheduling "+name+"()\n")
+			last = now
+			due = sched.next(now)
+			continue
+		}
+		if now.Before(due) {
+			continue
+		}
+		if now.Sub(due) > 2*check {
+			logger("planner", time.Now().Format(time.RFC850)+"  INFO: Missed "+name+"() run due at "+due.Format(time.RFC850)+", running now\n")
+		}
+		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Periodic "+name+"() Load\n")
+		job()
+		last = time.Now().Round(0)
+		due = sched.next(last)
+	}
+	logger("planner", time.Now().Format(time.RFC850)+"\n  INFO: *** Error: Exit on range ticker in function runScheduled("+name+"). ***\n\n")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	last := time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		refreshAt string
+		interval  time.Duration
+		wantErr   bool
+		want      time.Time
+	}{
+		{"interval", "", 15 * time.Minute, false, last.Add(15 * time.Minute)},
+		{"later today", "06:00,18:00", time.Hour, false, time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)},
+		{"tomorrow", "00:05", time.Hour, false, time.Date(2026, 10, 20, 0, 5, 0, 0, time.UTC)},
+		{"bad time falls back to the interval", "25:00", time.Hour, true, last.Add(time.Hour)},
+		{"nothing set runs daily", "", 0, true, last.Add(defaultScheduleInterval)},
+		{"negative interval runs daily", "", -time.Minute, true, last.Add(defaultScheduleInterval)},
+		{"bad time without an interval runs daily", "6pm", 0, true, last.Add(defaultScheduleInterval)},
+		{"refresh times without an interval", "12:00", 0, false, time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := newSchedule(test.refreshAt, test.interval)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: newSchedule(%q, %v) error = %v, want error %v", test.name, test.refreshAt, test.interval, err, test.wantErr)
+		}
+		if got := s.next(last); !got.Equal(test.want) {
+			t.Errorf("%s: next(%v) = %v, want %v", test.name, last, got, test.want)
+		}
+	}
+}
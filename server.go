@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// background holds the photos currently chosen by getPhotos, as paths
+// relative to config.PhotosDir, and how the page should fit them: "cover",
+// "contain" or, for two photos side by side, "pair".  No photos means the
+// fallback background.  text is the style of each panel's text, from
+// textStyles, and caption describes the photos, from photoCaption.
+var background struct {
+	sync.Mutex
+	photos  []string
+	fit     string
+	text    map[string]string
+	caption string
+}
+
+func setBackground(fit string, text map[string]string, caption string, photos ...string) {
+	background.Lock()
+	background.photos = photos
+	background.fit = fit
+	background.text = text
+	background.caption = caption
+	background.Unlock()
+}
+
+func getBackground() (string, map[string]string, string, []string) {
+	background.Lock()
+	defer background.Unlock()
+	return background.fit, background.text, background.caption, background.photos
+}
+
+// backgroundJSON is the current background as sent to the page, with how to
+// move from the last one: a "fade" over Transition seconds or a cut, and
+// whether to slowly pan and zoom across it for the Duration it is shown.
+type backgroundJSON struct {
+	URL               string            `json:"url"`
+	URLs              []string          `json:"urls"`
+	Fit               string            `json:"fit"`
+	Text              map[string]string `json:"text"`
+	Caption           string            `json:"caption"`
+	Transition        string            `json:"transition"`
+	TransitionSeconds int               `json:"transitionSeconds"`
+	KenBurns          bool              `json:"kenBurns"`
+	Duration          int               `json:"duration"`
+}
+
+func backgroundMessage(config configStruct) backgroundJSON {
+	fit, text, caption, photos := getBackground()
+	bg := backgroundJSON{
+		Fit:               fit,
+		Text:              text,
+		Caption:           caption,
+		Transition:        config.PhotoTransition,
+		TransitionSeconds: config.PhotoFadeSeconds,
+		KenBurns:          config.PhotoKenBurns,
+		Duration:          config.PhotoReloadInterval * 60,
+	}
+	if len(photos) == 0 {
+		bg.URL, bg.Fit = photoURL(""), "cover"
+	}
+	for _, photo := range photos {
+		bg.URLs = append(bg.URLs, photoURL(photo))
+	}
+	if len(bg.URLs) > 0 {
+		bg.URL = bg.URLs[0]
+	}
+	return bg
+}
+
+// fallbackBackground is shown when photosDir holds no usable photos: a dark
+// gradient that keeps the white text legible.
+const fallbackBackground = `<svg xmlns="http://www.w3.org/2000/svg" width="1920" height="1080" viewBox="0 0 1920 1080" preserveAspectRatio="none">
+<defs><linearGradient id="g" x1="0" y1="0" x2="1" y2="1">
+<stop offset="0" stop-color="#1b2a41"/><stop offset="1" stop-color="#324a5f"/>
+</linearGradient></defs>
+<rect width="1920" height="1080" fill="url(#g)"/>
+</svg>
+`
+
+// photoURL is the URL the planner's HTTP server serves photo under.  An
+// empty photo means the built-in fallback background.
+func photoURL(photo string) string {
+	if photo == "" {
+		return "/fallback.svg"
+	}
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(photo), "/") {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return "/photos/" + path.Join(parts...)
+}
+
+// startServer serves planner.html and the files it needs, along with the
+// current background photo, on config.HTTPAddr.  Only the page, css, js and
+// photos are exposed, along with the PIN-protected upload page; json/ holds
+// API keys and is never served.
+func startServer(config configStruct) {
+	mux := http.NewServeMux()
+
+	htmlDir := filepath.Dir(config.HTMLFile)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/"+filepath.Base(config.HTMLFile) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, config.HTMLFile)
+	})
+	mux.Handle("/css/", http.FileServer(http.Dir(htmlDir)))
+	mux.Handle("/js/", http.FileServer(http.Dir(htmlDir)))
+	mux.HandleFunc("/photos/", func(w http.ResponseWriter, r *http.Request) {
+		servePhoto(w, r, config)
+	})
+
+	handleUploads(mux, config)
+	handleCalendarAuth(mux, config)
+	handleReminders(mux)
+	handleAddEvent(mux, config)
+
+	mux.HandleFunc("/fallback.svg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, fallbackBackground)
+	})
+
+	// The page is sent new backgrounds, photos to preload and notice of
+	// changes to planner.html as they happen.  It falls back to polling
+	// /background if it can't stay connected.
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, config)
+	})
+	mux.HandleFunc("/background", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(backgroundMessage(config))
+	})
+	go watchPage(config)
+
+	logger("planner", time.Now().Format(time.RFC850)+"  INFO: Serving planner on http://"+config.HTTPAddr+"/\n")
+	err := http.ListenAndServe(config.HTTPAddr, mux)
+	logger("planner", time.Now().Format(time.RFC850)+"  ERROR: HTTP server stopped: "+err.Error()+"\n")
+}
+
+// servePhoto serves a photo from config.PhotosDir, using its pre-scaled
+// copy when the photo cache has one.  Otherwise a JPEG stored on its side,
+// as phones often do, is turned upright first using its EXIF orientation.
+func servePhoto(w http.ResponseWriter, r *http.Request, config configStruct) {
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/photos/"))
+	file := filepath.Join(config.PhotosDir, filepath.FromSlash(rel))
+	if photoType(file) == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if cached := cachedPhoto(config, strings.TrimPrefix(rel, "/")); cached != "" {
+		http.ServeFile(w, r, cached)
+		return
+	}
+
+	meta, err := readPhotoMeta(file)
+	if err != nil || meta.Orientation == 1 {
+		http.ServeFile(w, r, file)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Decoding "+file+": "+err.Error()+"\n")
+		http.ServeFile(w, r, file)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	jpeg.Encode(w, orientImage(img, meta.Orientation), &jpeg.Options{Quality: 90})
+}
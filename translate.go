@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// translation is a word of the day rendered in the second language.
+type translation struct {
+	Word       string `json:"word"`
+	POS        string `json:"pos"`
+	Definition string `json:"definition"`
+}
+
+// translator looks up a word of the day in another language.  found is false
+// when the translator simply has no entry for the word.
+type translator interface {
+	Translate(word string, pos string) (t translation, found bool, err error)
+}
+
+// newTranslator returns the translator named by config.Translator for
+// config.TranslateLanguage, or nil if translation is turned off.
+func newTranslator(config configStruct) (translator, error) {
+	if config.TranslateLanguage == "" {
+		return nil, nil
+	}
+	switch config.Translator {
+	case "", "dictionary":
+		path := strings.Replace(config.TranslateDictionary, "{lang}", config.TranslateLanguage, -1)
+		return &dictionaryTranslator{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown translator %q", config.Translator)
+}
+
+// dictionaryTranslator is the offline translator.  It reads a local
+// bilingual dictionary, a JSON object mapping each English word to its
+// translations, one per part of speech:
+//
+//	{"bereave": [{"pos": "verb", "word": "privar", "definition": "..."}]}
+//
+// The file is read on every lookup so it can be edited without a restart.
+type dictionaryTranslator struct {
+	path string
+}
+
+func (d *dictionaryTranslator) Translate(word string, pos string) (translation, bool, error) {
+	dictBytes, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return translation{}, false, fmt.Errorf("reading %s: %v", d.path, err)
+	}
+	var dict map[string][]translation
+	if err := json.Unmarshal(dictBytes, &dict); err != nil {
+		return translation{}, false, fmt.Errorf("parsing %s: %v", d.path, err)
+	}
+
+	// Dictionary entry IDs may carry a homograph number, as in "bear[2]"
+	if bracket := strings.IndexByte(word, '['); bracket != -1 {
+		word = word[:bracket]
+	}
+	entries := dict[strings.ToLower(strings.TrimSpace(word))]
+	if len(entries) == 0 {
+		return translation{}, false, nil
+	}
+	for _, t := range entries {
+		if strings.EqualFold(t.POS, pos) {
+			return t, true, nil
+		}
+	}
+	return entries[0], true, nil
+}
+
+// translateWOTD returns the translated word and definition for the WOTD
+// panel as HTML, or empty strings if translation is off or unavailable.
+func translateWOTD(config configStruct, wotdInfo wotdType) (string, string) {
+	tr, err := newTranslator(config)
+	if err != nil {
+		logger("wotd", time.Now().Format(time.RFC850)+"  ERROR: "+err.Error()+"\n")
+		return "", ""
+	}
+	if tr == nil {
+		return "", ""
+	}
+
+	t, found, err := tr.Translate(wotdInfo.Word, wotdInfo.POS)
+	if err != nil {
+		logger("wotd", time.Now().Format(time.RFC850)+"  ERROR: Translate("+wotdInfo.Word+"): "+err.Error()+"\n")
+		return "", ""
+	}
+	if !found {
+		logger("wotd", time.Now().Format(time.RFC850)+"  INFO: No "+config.TranslateLanguage+" translation for "+wotdInfo.Word+"\n")
+		return "", ""
+	}
+	logger("wotd", time.Now().Format(time.RFC850)+"  Translation: "+t.Word+"\n")
+
+	lang := html.EscapeString(config.TranslateLanguage)
+	word := "<span lang=\"" + lang + "\">" + html.EscapeString(t.Word) + "</span>"
+	def := ""
+	if t.Definition != "" {
+		def = "<span lang=\"" + lang + "\">" + html.EscapeString(t.Definition) + "</span>"
+	}
+	return word, def
+}
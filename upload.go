@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wrong PINs allowed before the upload page locks, and for how long.
+const (
+	maxPINFailures = 5
+	pinLockout     = 5 * time.Minute
+)
+
+const uploadCookie = "planner_upload"
+
+// uploadAuth checks the shared upload PIN, which also guards /add.  A
+// correct PIN earns a cookie holding a token derived from it and a secret
+// made at startup, so the PIN itself is never stored on the phone and a
+// restart signs everyone out.
+var uploadAuth struct {
+	sync.Mutex
+	secret   []byte
+	failures int
+	lockedTo time.Time
+}
+
+// unsafeName matches the characters not kept in an uploaded file's name.
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// handleUploads adds the photo upload page to mux, unless config.UploadPIN
+// is empty.
+func handleUploads(mux *http.ServeMux, config configStruct) {
+	if config.UploadPIN == "" {
+		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Photo uploads disabled, uploadPIN is not set\n")
+		return
+	}
+	uploadAuth.secret = make([]byte, 32)
+	if _, err := rand.Read(uploadAuth.secret); err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Photo uploads disabled: "+err.Error()+"\n")
+		return
+	}
+
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			showUploadPage(w, r, config, r.URL.Query().Get("msg"))
+		case r.Method != http.MethodPost:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case !uploadAuthorized(r, config):
+			http.Redirect(w, r, "/upload", http.StatusSeeOther)
+		default:
+			redirectUpload(w, r, uploadPhotos(w, r, config))
+		}
+	})
+	mux.HandleFunc("/upload/pin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg := checkPIN(w, r, config)
+		redirectUpload(w, r, msg)
+	})
+	mux.HandleFunc("/upload/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !uploadAuthorized(r, config) {
+			http.Redirect(w, r, "/upload", http.StatusSeeOther)
+			return
+		}
+		redirectUpload(w, r, deletePhoto(r.FormValue("photo"), config))
+	})
+}
+
+func redirectUpload(w http.ResponseWriter, r *http.Request, msg string) {
+	target := "/upload"
+	if msg != "" {
+		target += "?msg=" + url.QueryEscape(msg)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func uploadToken(config configStruct) string {
+	h := sha256.New()
+	h.Write(uploadAuth.secret)
+	io.WriteString(h, config.UploadPIN)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// uploadAuthorized reports whether r carries the cookie checkPIN sets.
+// Every cookie of that name is tried, as a stale one kept to /upload by an
+// older planner is sent as well.
+func uploadAuthorized(r *http.Request, config configStruct) bool {
+	token := []byte(uploadToken(config))
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == uploadCookie && subtle.ConstantTimeCompare([]byte(cookie.Value), token) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPIN signs the phone in if the PIN it sent is right.  After
+// maxPINFailures wrong PINs in a row every attempt is refused for
+// pinLockout, so the PIN can't simply be guessed.
+func checkPIN(w http.ResponseWriter, r *http.Request, config configStruct) string {
+	uploadAuth.Lock()
+	defer uploadAuth.Unlock()
+	if time.Now().Before(uploadAuth.lockedTo) {
+		return "Too many wrong PINs, try again later"
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("pin")), []byte(config.UploadPIN)) != 1 {
+		uploadAuth.failures++
+		logger("planner", time.Now().Format(time.RFC850)+"  INFO: Wrong upload PIN from "+r.RemoteAddr+"\n")
+		if uploadAuth.failures >= maxPINFailures {
+			uploadAuth.failures = 0
+			uploadAuth.lockedTo = time.Now().Add(pinLockout)
+			logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Upload page locked after "+strconv.Itoa(maxPINFailures)+" wrong PINs\n")
+		}
+		return "Wrong PIN"
+	}
+	uploadAuth.failures = 0
+	http.SetCookie(w, &http.Cookie{
+		Name:     uploadCookie,
+		Value:    uploadToken(config),
+		Path:     "/",
+		MaxAge:   int((90 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return ""
+}
+
+// uploadPhotos saves each photo posted to the upload page into
+// config.UploadDir and scales it for the display straight away.  Files that
+// aren't usable photos, or that are already in photosDir under any name,
+// are turned away.
+func uploadPhotos(w http.ResponseWriter, r *http.Request, config configStruct) string {
+	maxMB := config.MaxUploadMB
+	if maxMB <= 0 {
+		maxMB = 25
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxMB)<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return "Upload failed, the photos may be too large: " + err.Error()
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["photos"]
+	if len(files) == 0 {
+		return "Choose some photos to upload"
+	}
+
+	dir := filepath.Join(config.PhotosDir, filepath.FromSlash(config.UploadDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Creating "+dir+": "+err.Error()+"\n")
+		return "Upload failed, the photos folder can't be written to"
+	}
+	hashes := photoHashes(config)
+
+	var added, duplicates, rejected []string
+	for _, fh := range files {
+		name, err := savePhoto(fh, dir, hashes)
+		switch {
+		case errors.Is(err, errDuplicatePhoto):
+			duplicates = append(duplicates, fh.Filename)
+		case err != nil:
+			logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Upload of "+fh.Filename+" rejected: "+err.Error()+"\n")
+			rejected = append(rejected, fh.Filename)
+		default:
+			photo := path.Join(config.UploadDir, name)
+			logger("photo", time.Now().Format(time.RFC850)+"  INFO: Uploaded "+photo+" from "+r.RemoteAddr+"\n")
+			if cacheEnabled(config) {
+				if _, _, err := cachePhoto(config, photo); err != nil {
+					logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Caching "+photo+": "+err.Error()+"\n")
+				}
+			}
+			added = append(added, fh.Filename)
+		}
+	}
+	if cacheEnabled(config) && len(added) > 0 {
+		saveCacheIndex(config)
+	}
+
+	msg := fmt.Sprintf("Added %d photo(s).", len(added))
+	if len(duplicates) > 0 {
+		msg += " Already there: " + strings.Join(duplicates, ", ") + "."
+	}
+	if len(rejected) > 0 {
+		msg += " Not usable photos: " + strings.Join(rejected, ", ") + "."
+	}
+	return msg
+}
+
+var errDuplicatePhoto = errors.New("photo already in photosDir")
+
+// savePhoto writes an uploaded file into dir, returning the name it was
+// given.  It is written under a hidden name, which listPhotos ignores, and
+// only renamed once it is known to be a new photo that can be shown.
+func savePhoto(fh *multipart.FileHeader, dir string, hashes map[string]bool) (string, error) {
+	ext := strings.ToLower(filepath.Ext(fh.Filename))
+	if photoExtensions[ext] == "" {
+		return "", errors.New("not a JPEG, PNG or WebP file")
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(dir, ".upload-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(tmpName)
+		}
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	kind := photoType(tmpName)
+	if kind == "" || (kind == "heic" && !heicDecodable) {
+		return "", errors.New("not a JPEG, PNG or WebP photo")
+	}
+	if _, err := readPhotoMeta(tmpName); err != nil {
+		return "", err
+	}
+	hash, err := hashFile(tmpName)
+	if err != nil {
+		return "", err
+	}
+	if hashes[hash] {
+		return "", errDuplicatePhoto
+	}
+
+	base := strings.TrimSuffix(filepath.Base(filepath.ToSlash(fh.Filename)), filepath.Ext(fh.Filename))
+	base = strings.Trim(unsafeName.ReplaceAllString(base, "-"), "-.")
+	if base == "" {
+		base = "photo"
+	}
+	name := base + ext
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(dir, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = base + "-" + strconv.Itoa(n) + ext
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	keep = true
+	hashes[hash] = true
+	return name, nil
+}
+
+// photoHashes returns the content hash of every photo in photosDir, using
+// the photo cache's index where it is up to date.
+func photoHashes(config configStruct) map[string]bool {
+	hashes := make(map[string]bool)
+	for _, photo := range indexedPhotos(config) {
+		file := filepath.Join(config.PhotosDir, filepath.FromSlash(photo))
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		photoCache.Lock()
+		entry, ok := photoCache.index[photo]
+		photoCache.Unlock()
+		if ok && entry.ModTime.Equal(info.ModTime()) && entry.Size == info.Size() {
+			hashes[entry.Hash] = true
+			continue
+		}
+		if hash, err := hashFile(file); err == nil {
+			hashes[hash] = true
+		}
+	}
+	return hashes
+}
+
+// deletePhoto removes a photo, given relative to photosDir, along with its
+// caption sidecar.
+func deletePhoto(photo string, config configStruct) string {
+	rel := strings.TrimPrefix(path.Clean("/"+photo), "/")
+	file := filepath.Join(config.PhotosDir, filepath.FromSlash(rel))
+	if rel == "" || photoType(file) == "" {
+		return "No such photo"
+	}
+	if err := os.Remove(file); err != nil {
+		logger("photo", time.Now().Format(time.RFC850)+"  ERROR: Removing "+file+": "+err.Error()+"\n")
+		return "Couldn't remove " + rel
+	}
+	// Its caption sidecar goes too, under either of the names captions
+	// reads.  Without the extension, the name may be shared with another
+	// photo, such as beach.png beside beach.jpg, whose caption it then is.
+	os.Remove(file + ".txt")
+	if !sharesBaseName(file) {
+		os.Remove(strings.TrimSuffix(file, filepath.Ext(file)) + ".txt")
+	}
+	removePhotos(config, file)
+	logger("photo", time.Now().Format(time.RFC850)+"  INFO: Removed "+rel+" from the upload page\n")
+	return "Removed " + rel
+}
+
+// sharesBaseName reports whether another photo in file's directory has the
+// same name apart from its extension.
+func sharesBaseName(file string) bool {
+	infos, err := ioutil.ReadDir(filepath.Dir(file))
+	if err != nil {
+		// Keep the sidecar if unsure
+		return true
+	}
+	name := filepath.Base(file)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, info := range infos {
+		other := info.Name()
+		if other != name && !info.IsDir() && photoExtensions[strings.ToLower(filepath.Ext(other))] != "" &&
+			strings.TrimSuffix(other, filepath.Ext(other)) == base {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPhoto is one photo listed on the upload page.
+type uploadPhoto struct {
+	Name string
+	URL  string
+}
+
+func showUploadPage(w http.ResponseWriter, r *http.Request, config configStruct, msg string) {
+	page := struct {
+		Authorized bool
+		Message    string
+		Photos     []uploadPhoto
+	}{Authorized: uploadAuthorized(r, config), Message: msg}
+
+	if page.Authorized {
+		for _, photo := range indexedPhotos(config) {
+			page.Photos = append(page.Photos, uploadPhoto{Name: photo, URL: photoURL(photo)})
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := uploadPage.Execute(w, page); err != nil {
+		logger("planner", time.Now().Format(time.RFC850)+"  ERROR: Rendering upload page: "+err.Error()+"\n")
+	}
+}
+
+var uploadPage = template.Must(template.New("upload").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Planner Photos</title>
+<style>
+body { font-family: sans-serif; margin: 1rem; background: #1b2a41; color: white; }
+input, button { font-size: 1.1rem; margin: 0.3rem 0; }
+.msg { background: rgba(255, 255, 255, 0.15); padding: 0.5rem; border-radius: 0.4rem; }
+.photos { display: flex; flex-wrap: wrap; gap: 0.5rem; list-style: none; padding: 0; }
+.photos li { width: 150px; }
+.photos img { width: 150px; height: 100px; object-fit: cover; border-radius: 0.3rem; }
+.photos span { display: block; font-size: 0.7rem; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>Planner Photos</h1>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+{{if .Authorized}}
+<form method="post" action="/upload" enctype="multipart/form-data">
+<input type="file" name="photos" accept="image/jpeg,image/png,image/webp" multiple>
+<button type="submit">Upload</button>
+</form>
+<ul class="photos">
+{{range .Photos}}<li>
+<img src="{{.URL}}" loading="lazy" alt="">
+<span>{{.Name}}</span>
+<form method="post" action="/upload/delete" onsubmit="return confirm('Remove this photo?')">
+<input type="hidden" name="photo" value="{{.Name}}">
+<button type="submit">Remove</button>
+</form>
+</li>{{end}}
+</ul>
+{{else}}
+<form method="post" action="/upload/pin">
+<input type="password" name="pin" inputmode="numeric" autocomplete="off" placeholder="PIN" autofocus>
+<button type="submit">Sign in</button>
+</form>
+{{end}}
+</body>
+</html>
+`))